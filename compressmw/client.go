@@ -1,8 +1,15 @@
 package compressmw
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 var _ http.RoundTripper = (*roundtripfunc)(nil)
@@ -11,29 +18,502 @@ type roundtripfunc func(*http.Request) (*http.Response, error)
 
 func (rt roundtripfunc) RoundTrip(r *http.Request) (*http.Response, error) { return rt(r) }
 
+// A Transport is an http.RoundTripper that compresses non-empty request bodies with a registered Codec before handing them to Base.
+// WithRequestEncoding overrides its Encoding, Level, MinSize and content types for a single request.
+// A request that already has a Content-Encoding is sent as-is: its body's already encoded.
+// Don't change a Transport's fields once it's in use: they're checked on its first request.
+type Transport struct {
+	// Base sends the compressed requests. nil means http.DefaultTransport.
+	Base http.RoundTripper
+	// Encoding is the registered content-coding to compress with. "" means gzip.
+	Encoding string
+	// Level is checked against the Codec's Levels: 0 or -1 select its default.
+	Level int
+	// BrotliWindow is the log2 of brotli's sliding window when Encoding is "br", from 10 to 24. 0 means brotli's default of 22 (4 MiB).
+	// A smaller window saves memory on both ends, at some cost in compression.
+	BrotliWindow int
+	// Stream compresses the body as it's sent, in a goroutine, rather than reading it all into memory first:
+	// use it for multi-GB uploads. The request is sent with chunked transfer encoding, since its length isn't known in advance.
+	// If reading or compressing the body fails, RoundTrip returns that error; cancelling the request's context stops the upload.
+	Stream bool
+	// DisableFallback turns off retrying requests the server answers with 415 Unsupported Media Type. See fallback.go.
+	DisableFallback bool
+	// FallbackTTL is how long to remember that a host wants a different content-coding (or none) after a 415. 0 means 10 minutes.
+	FallbackTTL time.Duration
+	// MinSize is the smallest body worth compressing, in bytes: smaller bodies are sent as-is. 0 compresses everything.
+	// If the request's ContentLength is unknown, up to MinSize bytes of the body are read to find out.
+	MinSize int64
+	// ContentTypes, if non-empty, limits compression to bodies whose request Content-Type matches one of these patterns:
+	// exact ("application/json"), "type/*", or "*/*". Requests without a Content-Type are then sent as-is.
+	ContentTypes []string
+	// ExcludedContentTypes are never compressed, even if they match ContentTypes. nil means DefaultExcludedContentTypes;
+	// use an empty, non-nil slice to compress everything. Add "multipart/*" if your uploads are mostly already-compressed files.
+	ExcludedContentTypes []string
+
+	once  sync.Once
+	p     *uploadPolicy
+	err   error
+	hosts hostCache // content-codings learned from 415s
+}
+
+// uploadPolicy is a Transport's settings, checked and ready to use.
+type uploadPolicy struct {
+	o       offer
+	minSize int64
+	types   mediaTypes
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// policy looks up t.Encoding and checks t.Level.
+func (t *Transport) policy() (*uploadPolicy, error) {
+	encoding := t.Encoding
+	if encoding == "" {
+		encoding = "gzip"
+	}
+	o, err := newOffer(encoding, t.Level)
+	if err != nil {
+		return nil, err
+	}
+	if o.c, err = o.c.withBrotliWindow(t.BrotliWindow); err != nil {
+		return nil, err
+	}
+	return &uploadPolicy{o: o, minSize: max(t.MinSize, 0), types: newMediaTypes(t.ContentTypes, t.ExcludedContentTypes)}, nil
+}
+
+// loadPolicy is policy, the first time it's called.
+func (t *Transport) loadPolicy() (*uploadPolicy, error) {
+	t.once.Do(func() { t.p, t.err = t.policy() })
+	return t.p, t.err
+}
+
+// newOffer looks up encoding and checks lvl.
+func newOffer(encoding string, lvl int) (offer, error) {
+	c, err := lookupEncoding(encoding)
+	if err != nil {
+		return offer{}, err
+	}
+	lvl, err = c.level(lvl)
+	if err != nil {
+		return offer{}, err
+	}
+	return offer{c: c, lvl: lvl}, nil
+}
+
+// requestEncodingKey is the context key for WithRequestEncoding.
+type requestEncodingKey struct{}
+
+// requestEncoding is a per-request override of a Transport's Encoding and Level.
+type requestEncoding struct {
+	encoding string
+	lvl      int
+}
+
+// WithRequestEncoding returns a copy of ctx that tells a Transport how to compress the body of a request made with it,
+// whatever the Transport's Encoding, Level, MinSize and content types say.
+// encoding "identity" sends the body as-is. Level is checked against the Codec's Levels: 0 or -1 select its default.
+// An unregistered encoding or invalid level makes RoundTrip fail.
+func WithRequestEncoding(ctx context.Context, encoding string, level int) context.Context {
+	return context.WithValue(ctx, requestEncodingKey{}, requestEncoding{encoding: encoding, lvl: level})
+}
+
+// choose picks how to compress r's body: the zero offer means send it as-is.
+// If it needs to peek at the body to measure it, it returns the request to send instead of r.
+func (t *Transport) choose(r *http.Request) (offer, *http.Request, error) {
+	if len(contentCodings(r.Header.Values("Content-Encoding"))) > 0 { // the caller encoded it: we'd only hide their coding.
+		return offer{}, r, nil
+	}
+	if override, ok := r.Context().Value(requestEncodingKey{}).(requestEncoding); ok {
+		if strings.EqualFold(override.encoding, "identity") {
+			return offer{}, r, nil
+		}
+		o, err := newOffer(override.encoding, override.lvl)
+		return o, r, err
+	}
+	p, err := t.loadPolicy()
+	if err != nil {
+		return offer{}, r, err
+	}
+	o := p.o
+	if learned, ok := t.hosts.get(r.URL.Host); ok {
+		o = learned
+	}
+	if o.c == nil || !p.types.match(r.Header.Get("Content-Type")) {
+		return offer{}, r, nil
+	}
+	switch {
+	case p.minSize == 0 || r.ContentLength >= p.minSize:
+		return o, r, nil
+	case r.ContentLength > 0:
+		return offer{}, r, nil
+	}
+	// we don't know how big the body is: read up to minSize bytes of it to find out.
+	head := make([]byte, p.minSize)
+	n, err := io.ReadFull(r.Body, head)
+	r2 := r.Clone(r.Context())
+	switch err {
+	case nil: // at least minSize bytes: put them back in front of the rest.
+		r2.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		return o, r2, nil
+	case io.EOF, io.ErrUnexpectedEOF: // the whole body, and it's too small.
+		r.Body.Close()
+		head = head[:n]
+		r2.Body = io.NopCloser(bytes.NewReader(head))
+		r2.ContentLength = int64(n)
+		if r2.GetBody == nil {
+			r2.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(head)), nil }
+		}
+		return offer{}, r2, nil
+	default:
+		return offer{}, r, fmt.Errorf("compressmw: reading request body: %w", err)
+	}
+}
+
+// RoundTrip compresses r's body, if it has one, and sends it with Base.
+// Like any RoundTripper, it doesn't modify r: it sends a copy.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return t.base().RoundTrip(r)
+	}
+	if b, ok := r.Body.(interface{ Len() int }); ok && b.Len() == 0 {
+		return t.base().RoundTrip(r)
+	}
+	o, r, err := t.choose(r)
+	if err != nil {
+		r.Body.Close() // RoundTrip must always close the body.
+		return nil, err
+	}
+	if o.c == nil {
+		return t.base().RoundTrip(r)
+	}
+	resp, rp, err := t.send(r, o)
+	if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType || t.DisableFallback || rp == nil {
+		return resp, err
+	}
+	return t.fallback(r, o, resp, rp)
+}
+
+// replay gets a fresh copy of a request's uncompressed body, so we can send it again after a 415.
+type replay struct {
+	get  func() (io.ReadCloser, error)
+	size int64 // the body's length, or -1 if unknown
+}
+
+// send compresses r's body with o and sends it. If the uncompressed body can be sent again, it returns a replay.
+func (t *Transport) send(r *http.Request, o offer) (*http.Response, *replay, error) {
+	var rp *replay
+	if r.GetBody != nil {
+		rp = &replay{get: r.GetBody, size: r.ContentLength}
+	}
+	if t.Stream {
+		resp, err := t.roundTripStream(r, o)
+		return resp, rp, err
+	}
+	// read the entire body into memory, compress it, and send it.
+	buf := getbuf()
+	defer putbuf(buf)
+	enc := o.c.getwriter(buf, o.lvl)
+	n, err := io.Copy(enc, r.Body)
+	r.Body.Close()
+	if closeErr := o.c.putwriter(enc, o.lvl); err == nil {
+		err = closeErr // closing enc flushes the end of the stream into buf.
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("compressmw: compressing %s request body: %w", o.c.Name(), err)
+	}
+	// the base transport may still be writing the body after RoundTrip returns, and may replay it through GetBody at any time after that,
+	// so the payload can't live in buf: it goes back in the pool when we return. copy it out once; the GC owns the copy.
+	payload := bytes.Clone(buf.Bytes())
+	r2 := compressedRequest(r, o)
+	r2.Body = io.NopCloser(bytes.NewReader(payload))
+	r2.ContentLength = int64(len(payload))
+	r2.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(payload)), nil }
+	if rp == nil { // we can still get the body back by decompressing the payload.
+		rp = &replay{
+			get: func() (io.ReadCloser, error) {
+				return &decodedBody{c: o.c, body: io.NopCloser(bytes.NewReader(payload))}, nil
+			},
+			size: n,
+		}
+	}
+	resp, err := t.base().RoundTrip(r2)
+	return resp, rp, err
+}
+
+// compressedRequest returns a copy of r to send with o's Content-Encoding. The caller sets the body and GetBody.
+func compressedRequest(r *http.Request, o offer) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.Header.Set("Content-Encoding", o.c.Name())
+	r2.Header.Del("Content-Length")
+	return r2
+}
+
+// compressPipe compresses a body in a goroutine, as the base transport reads pr.
+type compressPipe struct {
+	pr   *io.PipeReader
+	body io.ReadCloser // the body being compressed
+
+	mu  sync.Mutex
+	err error // reading or compressing the body failed
+}
+
+// failed returns the error reading or compressing the body, if there's been one yet.
+func (p *compressPipe) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// pipe starts compressing body with o. Cancelling ctx stops both ends of the pipe.
+func (o offer) pipe(ctx context.Context, body io.ReadCloser) *compressPipe {
+	pr, pw := io.Pipe()
+	p := &compressPipe{pr: pr, body: body}
+	stop := context.AfterFunc(ctx, func() { pw.CloseWithError(ctx.Err()) })
+	go func() {
+		defer stop()
+		enc := o.c.getwriter(pw, o.lvl)
+		_, err := io.Copy(enc, body)
+		body.Close()
+		if closeErr := o.c.putwriter(enc, o.lvl); err == nil {
+			err = closeErr
+		}
+		if err != nil && err != io.ErrClosedPipe { // ErrClosedPipe: the base transport stopped reading. that's its error to report, not ours.
+			err = fmt.Errorf("compressmw: compressing %s request body: %w", o.c.Name(), err)
+		} else {
+			err = nil
+		}
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		pw.CloseWithError(err) // p.err is set before pw is closed: if the base transport sees our error, so will we.
+	}()
+	return p
+}
+
+// roundTripStream is RoundTrip for t.Stream: it compresses r.Body through a pipe as the base transport reads it.
+// If r has a GetBody, so does the compressed request: each call compresses a fresh copy of the body through a new pipe.
+func (t *Transport) roundTripStream(r *http.Request, o offer) (*http.Response, error) {
+	ctx := r.Context()
+	var (
+		mu   sync.Mutex
+		last = o.pipe(ctx, r.Body) // the pipe for the latest attempt at sending the body
+	)
+	r2 := compressedRequest(r, o)
+	r2.Body = last.pr
+	r2.ContentLength = -1 // chunked.
+	r2.GetBody = nil
+	if r.GetBody != nil {
+		r2.GetBody = func() (io.ReadCloser, error) {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			p := o.pipe(ctx, body)
+			mu.Lock()
+			last = p
+			mu.Unlock()
+			return p.pr, nil
+		}
+	}
+	resp, err := t.base().RoundTrip(r2)
+	if err != nil {
+		mu.Lock()
+		p := last
+		mu.Unlock()
+		// the base transport should have closed the body, but make sure the goroutine can't block on the pipe forever,
+		// or on a body that never sends another byte: don't wait for it.
+		p.pr.CloseWithError(err)
+		p.body.Close()
+		if err := p.failed(); err != nil {
+			return nil, err
+		}
+	}
+	return resp, err
+}
+
+// ClientCompressBody is a RoundTripper that compresses non-nil request bodies with the registered Codec named by encoding.
+// Level is checked against the Codec's Levels: 0 or -1 select its default.
+// It panics if encoding isn't registered or the level is out of range. See Transport for streaming.
+func ClientCompressBody(rt http.RoundTripper, encoding string, level int) http.RoundTripper {
+	t := &Transport{Base: rt, Encoding: encoding, Level: level}
+	if _, err := t.loadPolicy(); err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// A DecompressTransport is an http.RoundTripper that asks for compressed responses and transparently decompresses them,
+// as http.Transport does for gzip alone.
+//
+// Like http.Transport, it leaves requests alone if they already set Accept-Encoding (the caller gets the body as sent),
+// ask for a Range, or are HEAD requests. Otherwise it sends Accept-Encoding with Encodings, in order,
+// and if the response's Content-Encoding is one of them, it decodes the body with a pooled Decoder,
+// removes the Content-Encoding and Content-Length headers, and sets resp.Uncompressed.
+type DecompressTransport struct {
+	// Base sends the requests. nil means http.DefaultTransport.
+	// Since Accept-Encoding is already set, http.Transport won't decompress gzip itself.
+	Base http.RoundTripper
+	// Encodings are the registered content-codings to accept, most preferred first. Empty means br, zstd, gzip.
+	Encodings []string
+}
+
+var _ http.RoundTripper = (*DecompressTransport)(nil)
+
+// defaultAcceptEncodings are the content-codings a DecompressTransport asks for when its Encodings are empty.
+var defaultAcceptEncodings = []string{"br", "zstd", "gzip"}
+
+func (t *DecompressTransport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// codecs looks up t.Encodings.
+func (t *DecompressTransport) codecs() ([]*codec, error) {
+	encodings := t.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultAcceptEncodings
+	}
+	codecs := make([]*codec, len(encodings))
+	for i := range encodings {
+		c, err := lookupEncoding(encodings[i])
+		if err != nil {
+			return nil, err
+		}
+		codecs[i] = c
+	}
+	return codecs, nil
+}
+
+// RoundTrip sends r with Accept-Encoding and decompresses the response. Like any RoundTripper, it doesn't modify r: it sends a copy.
+func (t *DecompressTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("Accept-Encoding") != "" || r.Header.Get("Range") != "" || r.Method == http.MethodHead {
+		return t.base().RoundTrip(r)
+	}
+	codecs, err := t.codecs()
+	if err != nil {
+		if r.Body != nil {
+			r.Body.Close() // RoundTrip must always close the body.
+		}
+		return nil, err
+	}
+	names := make([]string, len(codecs))
+	for i := range codecs {
+		names[i] = codecs[i].Name()
+	}
+	r2 := r.Clone(r.Context())
+	r2.Header.Set("Accept-Encoding", strings.Join(names, ", "))
+	resp, err := t.base().RoundTrip(r2)
+	if err != nil {
+		return nil, err
+	}
+	decodeResponse(resp, codecs)
+	return resp, nil
+}
+
+// decodeResponse replaces resp.Body with a decompressing reader, if it's encoded with exactly one of codecs.
+// Anything else (identity, or a stack of codings like "gzip, br") is passed through as sent.
+func decodeResponse(resp *http.Response, codecs []*codec) {
+	ce := resp.Header.Values("Content-Encoding")
+	if len(ce) != 1 || strings.Contains(ce[0], ",") || resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	i, c := codecAt(ce, codecs)
+	if i == -1 {
+		return
+	}
+	resp.Body = &decodedBody{c: c, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// decodedBody decompresses a response body with a pooled Decoder.
+// Like http.Transport's gzip reader, it doesn't read the stream's header until the first Read, so RoundTrip doesn't block on the body.
+type decodedBody struct {
+	c    *codec
+	body io.ReadCloser // the compressed body
+	mu   sync.Mutex    // guards dec: Close may be called while another goroutine is in Read.
+	dec  Decoder       // nil until the first Read
+	err  error         // sticky: a failed Reset, or errBodyClosed
+}
+
+// errBodyClosed is returned from a decodedBody's Read after Close: its Decoder is back in the pool.
+var errBodyClosed = errors.New("compressmw: read on closed response body")
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.dec == nil {
+		dec, err := b.c.getreader(b.body)
+		if err != nil {
+			b.err = fmt.Errorf("compressmw: malformed %s response body: %w", b.c.Name(), err)
+			return 0, b.err
+		}
+		b.dec = dec
+	}
+	return b.dec.Read(p)
+}
+
+// Close closes the compressed body, which unblocks any Read in progress, then returns the Decoder to the pool.
+func (b *decodedBody) Close() error {
+	err := b.body.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dec != nil {
+		b.c.putreader(b.dec)
+		b.dec = nil
+	}
+	b.err = errBodyClosed
+	return err
+}
+
+// ClientAcceptCompressed is a RoundTripper that asks for responses compressed with the registered Codecs named by encodings, most preferred first,
+// and transparently decompresses them. With no encodings, it accepts br, zstd and gzip. It panics if an encoding isn't registered.
+// See DecompressTransport.
+func ClientAcceptCompressed(rt http.RoundTripper, encodings ...string) http.RoundTripper {
+	t := &DecompressTransport{Base: rt, Encodings: encodings}
+	if _, err := t.codecs(); err != nil {
+		panic(err)
+	}
+	return t
+}
 
 // ClientGzipBody is a RoundTripper that compresses non-nil request bodies with gzip. Level is in the range 1(gzip.BestSpeed) to 9(gzip.BestCompression). 0 or -1 default to 6.
 func ClientGzipBody(rt http.RoundTripper, level int) http.RoundTripper {
-	level = checkgziplevel(level)
-
-	return roundtripfunc(func(r *http.Request) (*http.Response, error) {
-		if r.Body == nil {
-			return rt.RoundTrip(r)
-		}
-		if b, ok := r.Body.(interface{ Len() int }); ok && b.Len() == 0 {
-			return rt.RoundTrip(r)
-		}
-		// naive solution: read the entire body into memory, compress it, and send it.
-		// I don't want to deal with pipes. If we get into streaming http bodies (usually a bad idea, but it happens)
-		// we can revisit this.
-		buf := getbuf()
-		defer putbuf(buf)
-		gw := getzipwriter(buf, level)
-		io.Copy(gw, r.Body)
-		gw.Close()
-		r.Body = io.NopCloser(buf)
-		r.ContentLength = int64(buf.Len())
-		r.Header.Set("Content-Encoding", "gzip")
-		return rt.RoundTrip(r)
-	})
+	return ClientCompressBody(rt, "gzip", level)
+}
+
+// ClientBrotliBody is a RoundTripper that compresses non-nil request bodies with brotli. Quality is in the range 1 to 11(brotli.BestCompression). 0 or -1 default to 6.
+// See ClientGzipBody for the gzip equivalent, ServerAcceptBrotli for the matching server middleware, and Transport for setting the window size.
+func ClientBrotliBody(rt http.RoundTripper, quality int) http.RoundTripper {
+	return ClientCompressBody(rt, "br", quality)
+}
+
+// ClientDeflateBody is a RoundTripper that compresses non-nil request bodies with deflate (zlib-wrapped, per RFC 9110).
+// Level is in the range 1(flate.BestSpeed) to 9(flate.BestCompression). 0 or -1 default to 6.
+// See ClientGzipBody for the gzip equivalent, and ServerAcceptDeflate for the matching server middleware.
+func ClientDeflateBody(rt http.RoundTripper, level int) http.RoundTripper {
+	return ClientCompressBody(rt, "deflate", level)
+}
+
+// ClientZstdBody is a RoundTripper that compresses non-nil request bodies with zstd. Level is in the range 1(zstd.SpeedFastest) to 4(zstd.SpeedBestCompression). 0 or -1 default to 2.
+// See ClientGzipBody for the gzip equivalent, and ServerAcceptZstd for the matching server middleware.
+func ClientZstdBody(rt http.RoundTripper, level int) http.RoundTripper {
+	return ClientCompressBody(rt, "zstd", level)
 }
@@ -0,0 +1,344 @@
+// codec.go defines the Codec interface and the registry of content-codings the middleware knows how to apply and remove.
+// gzip, zstd, br (brotli) and deflate are registered out of the box; Register adds more.
+package compressmw
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A Codec is a content-coding (RFC 9110 §8.4.1) such as "gzip" or "zstd".
+//
+// The middleware pools the Encoders and Decoders a Codec creates (writers per level, like the original gzip pools),
+// so NewWriter and NewReader are only called when a pool is empty: every Encoder and Decoder is Reset before each use.
+type Codec interface {
+	// Name is the canonical content-coding token, as sent in Content-Encoding. e.g, "gzip".
+	Name() string
+	// Aliases are other tokens that mean the same thing as Name. e.g, "x-gzip".
+	Aliases() []string
+	// Levels reports the valid compression levels, 1 <= min <= level <= max, and the default level used for 0 or -1.
+	// 0 and -1 always mean the default, so they (and any negative level, like gzip.HuffmanOnly) can't be offered.
+	Levels() (min, max, def int)
+	// NewWriter returns a new Encoder at lvl. lvl has already been checked against Levels.
+	NewWriter(lvl int) Encoder
+	// NewReader returns a new Decoder.
+	NewReader() Decoder
+}
+
+// An Encoder compresses everything written to it into the io.Writer passed to Reset. Close must flush the end of the stream, but not close the underlying writer.
+// If it also has a Flush() error method that writes out everything buffered so far in a form the reader can decode, as gzip's does,
+// flushing a compressed response (for server-sent events, say) calls it.
+// *gzip.Writer and *zstd.Encoder are Encoders.
+type Encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// A Decoder decompresses the io.Reader passed to Reset.
+// The middleware never closes a Decoder, since it's returned to the pool.
+// *gzip.Reader and *zstd.Decoder (with a concurrency of 1) are Decoders.
+type Decoder interface {
+	io.Reader
+	Reset(r io.Reader) error
+}
+
+// codec is a registered Codec along with its pools.
+type codec struct {
+	Codec
+	min, max, def int
+	writers       []sync.Pool // indexed by level. as with the original gzip pools, we "waste" the levels below min.
+	readers       sync.Pool
+}
+
+// codecRegistry maps content-coding tokens to codecs.
+type codecRegistry struct {
+	sync.RWMutex
+	byToken map[string]*codec // by lowercase token
+}
+
+// registry holds every codec the middleware knows about: the built-ins plus anything passed to Register.
+// it's initialized by a function rather than an init() so package-level middleware like GinAcceptGzip can look up codecs during initialization.
+var registry = newRegistry(gzipCodec{}, zstdCodec{}, brotliCodec{}, deflateCodec{})
+
+func newRegistry(builtin ...Codec) *codecRegistry {
+	r := &codecRegistry{byToken: make(map[string]*codec)}
+	for _, c := range builtin {
+		r.register(c)
+	}
+	return r
+}
+
+// Register makes a Codec available to the middleware under its Name and Aliases.
+// Like database/sql.Register, it panics if c is nil or any of its tokens are already registered.
+// Call it from an init function: middleware looks up its codecs when it's constructed.
+func Register(c Codec) { registry.register(c) }
+
+func (r *codecRegistry) register(c Codec) {
+	if c == nil {
+		panic("compressmw: Register codec is nil")
+	}
+	entry := newCodec(c)
+
+	r.Lock()
+	defer r.Unlock()
+	tokens := append([]string{c.Name()}, c.Aliases()...)
+	for _, tok := range tokens {
+		if _, ok := r.byToken[strings.ToLower(tok)]; ok {
+			panic(fmt.Errorf("compressmw: Register called twice for content-coding %q", tok))
+		}
+	}
+	for _, tok := range tokens {
+		r.byToken[strings.ToLower(tok)] = entry
+	}
+}
+
+// newCodec sets up the pools for c. It panics if c's Levels are invalid.
+func newCodec(c Codec) *codec {
+	min, max, def := c.Levels()
+	if min < 1 || min > max || def < min || def > max {
+		panic(fmt.Errorf("compressmw: codec %q: invalid levels: min %d, max %d, default %d (want 1 <= min <= default <= max: 0 and -1 mean the default)", c.Name(), min, max, def))
+	}
+	entry := &codec{Codec: c, min: min, max: max, def: def, writers: make([]sync.Pool, max+1)}
+	for lvl := min; lvl <= max; lvl++ {
+		lvl := lvl
+		entry.writers[lvl].New = func() interface{} { return c.NewWriter(lvl) }
+	}
+	entry.readers.New = func() interface{} { return c.NewReader() }
+	return entry
+}
+
+// Lookup returns the Codec registered for the content-coding token, which may be a Name or an Alias. Tokens are case-insensitive.
+func Lookup(token string) (Codec, bool) {
+	c := lookup(token)
+	if c == nil {
+		return nil, false
+	}
+	return c.Codec, true
+}
+
+// lookup returns the codec registered for token, or nil.
+func lookup(token string) *codec {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.byToken[strings.ToLower(strings.TrimSpace(token))]
+}
+
+// lookupEncoding is lookup with an error for unregistered encodings.
+func lookupEncoding(encoding string) (*codec, error) {
+	c := lookup(encoding)
+	if c == nil {
+		return nil, fmt.Errorf("compressmw: unknown content-coding %q: did you forget to Register it?", encoding)
+	}
+	return c, nil
+}
+
+// level returns the level to use for lvl: the default for 0 or -1, lvl itself if it's in range, or an error.
+func (c *codec) level(lvl int) (int, error) {
+	switch {
+	case lvl == 0 || lvl == -1:
+		return c.def, nil
+	case c.min <= lvl && lvl <= c.max:
+		return lvl, nil
+	default:
+		return 0, fmt.Errorf("invalid %s compression level: expected %d <= level <= %d (or 0 or -1 for the default), got %d", c.Name(), c.min, c.max, lvl)
+	}
+}
+
+// registeredEncodings returns the Names of every registered codec, sorted.
+func registeredEncodings() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	var names []string
+	for _, c := range registry.byToken {
+		if !slices.Contains(names, c.Name()) {
+			names = append(names, c.Name())
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// contentCodings splits Content-Encoding headers into their codings, in the order they were applied, dropping "identity" (which is no coding at all) and empty elements.
+func contentCodings(headers []string) []string {
+	var codings []string
+	for _, h := range headers {
+		for _, v := range strings.Split(h, ",") {
+			if v = strings.TrimSpace(v); v != "" && !strings.EqualFold(v, "identity") {
+				codings = append(codings, v)
+			}
+		}
+	}
+	return codings
+}
+
+// codecAt returns the index of the first header in headers that names one of codecs, and that codec.
+// If codecs is empty, any registered codec matches.
+// It splits on commas, so it can handle "br, gzip" or "gzip, br". It returns -1, nil if there's no match.
+func codecAt(headers []string, codecs []*codec) (int, *codec) {
+	for i := range headers {
+		for _, v := range strings.Split(headers[i], ",") {
+			c := lookup(v)
+			if c == nil {
+				continue
+			}
+			if len(codecs) == 0 {
+				return i, c
+			}
+			for _, want := range codecs {
+				if c == want {
+					return i, c
+				}
+			}
+		}
+	}
+	return -1, nil
+}
+
+// gzipCodec is the built-in "gzip" Codec, backed by compress/gzip. Levels run from 1(gzip.BestSpeed) to 9(gzip.BestCompression), defaulting to 6.
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string                { return "gzip" }
+func (gzipCodec) Aliases() []string           { return []string{"x-gzip"} }
+func (gzipCodec) Levels() (min, max, def int) { return gzip.BestSpeed, gzip.BestCompression, 6 }
+func (gzipCodec) NewReader() Decoder          { return new(gzip.Reader) }
+func (gzipCodec) NewWriter(lvl int) Encoder {
+	z, err := gzip.NewWriterLevel(nil, lvl)
+	if err != nil {
+		panic(err)
+	}
+	return z
+}
+
+// zstdCodec is the built-in "zstd" Codec, backed by github.com/klauspost/compress/zstd.
+// Levels are zstd.EncoderLevels, from 1(zstd.SpeedFastest) to 4(zstd.SpeedBestCompression), defaulting to 2(zstd.SpeedDefault).
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string      { return "zstd" }
+func (zstdCodec) Aliases() []string { return nil }
+func (zstdCodec) Levels() (min, max, def int) {
+	return int(zstd.SpeedFastest), int(zstd.SpeedBestCompression), int(zstd.SpeedDefault)
+}
+
+func (zstdCodec) NewReader() Decoder {
+	// a concurrency of 1 decodes synchronously on the caller's goroutine, so a pooled decoder doesn't hold on to background goroutines.
+	// RFC 9659 limits the zstd content-coding's window to 8 MiB: a frame declaring more (up to 512 MiB) is refused, not allocated.
+	z, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20))
+	if err != nil {
+		panic(err)
+	}
+	return z
+}
+
+func (zstdCodec) NewWriter(lvl int) Encoder {
+	z, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevel(lvl)), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic(err)
+	}
+	return z
+}
+
+// brotliCodec is the built-in "br" Codec, backed by github.com/andybalholm/brotli.
+// Levels are brotli qualities from 1 to 11(brotli.BestCompression), defaulting to 6(brotli.DefaultCompression).
+// Quality 0 isn't available, since 0 selects the default.
+type brotliCodec struct {
+	lgwin int // log2 of the sliding window, from 10 to 24. 0 is brotli's default of 22 (4 MiB).
+}
+
+func (brotliCodec) Name() string      { return "br" }
+func (brotliCodec) Aliases() []string { return nil }
+func (brotliCodec) Levels() (min, max, def int) {
+	return 1, brotli.BestCompression, brotli.DefaultCompression
+}
+func (brotliCodec) NewReader() Decoder { return brotli.NewReader(nil) }
+func (b brotliCodec) NewWriter(lvl int) Encoder {
+	return brotli.NewWriterOptions(nil, brotli.WriterOptions{Quality: lvl, LGWin: b.lgwin})
+}
+
+// brotliWindows holds a "br" codec (and its pools) for each non-default window size in use, by lgwin.
+// They're never registered: only the Compressors and Transports with that BrotliWindow use them. Decoding needs no window setting.
+var brotliWindows sync.Map
+
+// withBrotliWindow returns the codec to use for c with a brotli window of 2^lgwin bytes: c itself, unless it's "br" and lgwin isn't 0.
+func (c *codec) withBrotliWindow(lgwin int) (*codec, error) {
+	if lgwin == 0 || c.Name() != "br" {
+		return c, nil
+	}
+	if lgwin < 10 || lgwin > 24 {
+		return nil, fmt.Errorf("invalid brotli window: expected 10 <= lgwin <= 24 (or 0 for the default), got %d", lgwin)
+	}
+	if bc, ok := brotliWindows.Load(lgwin); ok {
+		return bc.(*codec), nil
+	}
+	bc, _ := brotliWindows.LoadOrStore(lgwin, newCodec(brotliCodec{lgwin: lgwin}))
+	return bc.(*codec), nil
+}
+
+// deflateCodec is the built-in "deflate" Codec: per RFC 9110 §8.4.1.2, a zlib-wrapped (RFC 1950) deflate stream, backed by compress/zlib.
+// Levels run from 1(flate.BestSpeed) to 9(flate.BestCompression), defaulting to 6.
+//
+// Plenty of old clients and servers send raw deflate (RFC 1951) under the same name, so the Decoder accepts either: see deflateReader.
+type deflateCodec struct{}
+
+func (deflateCodec) Name() string                { return "deflate" }
+func (deflateCodec) Aliases() []string           { return nil }
+func (deflateCodec) Levels() (min, max, def int) { return flate.BestSpeed, flate.BestCompression, 6 }
+func (deflateCodec) NewReader() Decoder          { return &deflateReader{br: bufio.NewReader(nil)} }
+func (deflateCodec) NewWriter(lvl int) Encoder {
+	z, err := zlib.NewWriterLevel(nil, lvl)
+	if err != nil {
+		panic(err)
+	}
+	return z
+}
+
+// deflateReader decodes "deflate" bodies, zlib-wrapped or raw, telling them apart by the first two bytes.
+// It keeps one of each reader around, so a pooled deflateReader doesn't allocate for either kind.
+type deflateReader struct {
+	br   *bufio.Reader // the stream. it's an io.ByteReader, so flate doesn't buffer it again.
+	zlib io.ReadCloser // nil until the first zlib stream
+	raw  io.ReadCloser // nil until the first raw stream
+	cur  io.Reader
+}
+
+func (d *deflateReader) Read(p []byte) (int, error) { return d.cur.Read(p) }
+
+// Reset starts decoding r. An empty stream reads as empty, and Reset returns io.EOF.
+func (d *deflateReader) Reset(r io.Reader) error {
+	d.br.Reset(r)
+	head, err := d.br.Peek(2)
+	switch {
+	case len(head) == 0 && err == io.EOF:
+		d.cur = eofreader{}
+		return io.EOF
+	case isZlibHeader(head) && d.zlib == nil:
+		d.zlib, err = zlib.NewReader(d.br)
+		d.cur = d.zlib
+		return err
+	case isZlibHeader(head):
+		d.cur = d.zlib
+		return d.zlib.(zlib.Resetter).Reset(d.br, nil)
+	case d.raw == nil:
+		d.raw = flate.NewReader(d.br)
+		d.cur = d.raw
+		return nil
+	default:
+		d.cur = d.raw
+		return d.raw.(flate.Resetter).Reset(d.br, nil)
+	}
+}
+
+// isZlibHeader reports whether head starts with a zlib header (RFC 1950 §2.2): the deflate method with a window of at most 32 KiB,
+// and a check that makes the first two bytes a multiple of 31. It's the same heuristic browsers use: a raw deflate stream rarely starts that way.
+func isZlibHeader(head []byte) bool {
+	return len(head) == 2 && head[0]&0x0f == 8 && head[0]>>4 <= 7 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0
+}
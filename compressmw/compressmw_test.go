@@ -2,16 +2,30 @@ package compressmw_test
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
 	"github.com/runpod/rpcompress/compressmw"
 )
 
@@ -119,7 +133,15 @@ func TestServerAccept(t *testing.T) {
 	}
 	req.Header.Set("Content-Encoding", "gzip")
 
-	compressmw.ServerAcceptGzip(echo).ServeHTTP(rec, req)
+	req.Header.Set("Content-Length", fmt.Sprint(src.Len()))
+
+	compressmw.ServerAcceptGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the compressed body's length isn't the decoded body's.
+		if r.ContentLength != -1 || r.Header.Get("Content-Length") != "" {
+			t.Errorf("got ContentLength %d, Content-Length %q, want -1 and none", r.ContentLength, r.Header.Get("Content-Length"))
+		}
+		echo.ServeHTTP(w, r)
+	})).ServeHTTP(rec, req)
 	got := rec.Body.String()
 	if got != want {
 		t.Errorf("got %q, want %q", got, want)
@@ -181,6 +203,59 @@ func TestGinGzipOrBrotliBodies(t *testing.T) {
 	}
 }
 
+func TestGinCompressor(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	for _, tt := range []struct {
+		opts   []compressmw.Option
+		accept string
+		want   string // "" for identity
+	}{
+		{accept: "gzip, zstd, br", want: "br"},
+		{accept: "gzip, br;q=0.5", want: "gzip"},
+		{opts: []compressmw.Option{compressmw.WithPreferOrder()}, accept: "gzip, br;q=0.5", want: "br"},
+		{opts: []compressmw.Option{compressmw.WithPreferOrder()}, accept: "gzip, br;q=0", want: "gzip"},
+		{opts: []compressmw.Option{compressmw.WithEncodings("gzip", "zstd"), compressmw.WithPreferOrder()}, accept: "zstd, br, gzip;q=0.1", want: "gzip"},
+		{opts: []compressmw.Option{compressmw.WithLevel("br", 11), compressmw.WithLevel("gzip", 1)}, accept: "zstd;q=0.5, gzip", want: "gzip"},
+		{accept: "identity", want: ""},
+	} {
+		router := gin.New()
+		router.Use(compressmw.GinCompressor(tt.opts...))
+		router.POST("/foo", func(c *gin.Context) {
+			if ae := c.Request.Header.Get("Accept-Encoding"); tt.want != "" && ae != "" {
+				t.Errorf("%q: the handler saw Accept-Encoding %q", tt.accept, ae)
+			}
+			io.Copy(c.Writer, c.Request.Body)
+		})
+		req := httptest.NewRequest("POST", "/foo", strings.NewReader(want))
+		req.Header.Set("Accept-Encoding", tt.accept)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("%q: got Content-Encoding %q, want %q", tt.accept, got, tt.want)
+			continue
+		}
+		if got, err := decode(tt.want, rec.Body); err != nil || got != want {
+			t.Errorf("%q: got %q, %v, want %q", tt.accept, got, err, want)
+		}
+	}
+
+	for _, opts := range [][]compressmw.Option{
+		{compressmw.WithLevel("br", 12)},
+		{compressmw.WithEncodings("deflate-ish")},
+		{compressmw.WithMaxSize(1)},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("GinCompressor(%d options): didn't panic", len(opts))
+				}
+			}()
+			compressmw.GinCompressor(opts...)
+		}()
+	}
+}
+
 // implementation of TestGinGzipBodies per-level
 func testGinGzipBodies(t *testing.T, lvl int) {
 	router := gin.New()
@@ -347,3 +422,1867 @@ func testServerGzip(t *testing.T, lvl int) {
 	}
 	resp.Body.Close()
 }
+
+func TestZstdRoundTrip(t *testing.T) {
+	t.Parallel()
+	for lvl := -1; lvl <= 4; lvl++ {
+		lvl := lvl
+		t.Run(fmt.Sprintf("%+2d", lvl), func(t *testing.T) {
+			t.Parallel()
+			const want = "<this is the body>"
+			s := httptest.NewServer(compressmw.ServerAcceptZstd(echo))
+			t.Cleanup(s.Close)
+			client := &http.Client{Transport: compressmw.ClientZstdBody(http.DefaultTransport, lvl)}
+			resp, err := client.Post(s.URL+"/foo", "text/plain", strings.NewReader(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != want {
+				t.Errorf("got %q, want %q", b, want)
+			}
+		})
+	}
+}
+
+func TestServerZstd(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	for lvl := -1; lvl <= 4; lvl++ {
+		req, err := http.NewRequest("POST", "/foo", strings.NewReader(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "zstd")
+		rec := httptest.NewRecorder()
+		compressmw.ServerZstdResponseBody(echo, lvl).ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != "zstd" {
+			t.Errorf("level %d: got Content-Encoding %q, want %q", lvl, got, "zstd")
+		}
+		if got, err := decode("zstd", rec.Body); err != nil {
+			t.Errorf("level %d: error reading response body: %v", lvl, err)
+		} else if got != want {
+			t.Errorf("level %d: got %q, want %q", lvl, got, want)
+		}
+	}
+}
+
+func TestGinZstd(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	router := gin.New()
+	router.Use(compressmw.GinAcceptZstd, compressmw.GinZstdBodies(0))
+	router.POST("/foo", func(c *gin.Context) {
+		io.Copy(c.Writer, c.Request.Body)
+	})
+
+	var src bytes.Buffer
+	zw, _ := zstd.NewWriter(&src)
+	zw.Write([]byte(want))
+	zw.Close()
+	req, err := http.NewRequest("POST", "/foo", &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "zstd")
+	req.Header.Set("Accept-Encoding", "zstd")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "zstd" {
+		t.Errorf("got Content-Encoding %q, want %q", got, "zstd")
+	}
+	if got, err := decode("zstd", rec.Body); err != nil {
+		t.Errorf("error reading response body: %v", err)
+	} else if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBrotli(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	s := httptest.NewServer(compressmw.ServerAcceptBrotli(echo))
+	t.Cleanup(s.Close)
+	for lvl := -1; lvl <= 11; lvl++ {
+		client := &http.Client{Transport: compressmw.ClientBrotliBody(http.DefaultTransport, lvl)}
+		resp, err := client.Post(s.URL+"/foo", "text/plain", strings.NewReader(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(b) != want {
+			t.Errorf("quality %d: round trip: got %q, %v, want %q", lvl, b, err, want)
+		}
+
+		req := httptest.NewRequest("POST", "/foo", strings.NewReader(want))
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		rec := httptest.NewRecorder()
+		compressmw.ServerBrotliResponseBody(echo, lvl).ServeHTTP(rec, req)
+		if got, err := decode("br", rec.Body); rec.Header().Get("Content-Encoding") != "br" || err != nil || got != want {
+			t.Errorf("quality %d: response: got %q (Content-Encoding %q), %v, want %q", lvl, got, rec.Header().Get("Content-Encoding"), err, want)
+		}
+	}
+
+	// a repeat further back than the window can't refer back to the original: with a 1 KiB window, a repeated 64 KiB block compresses to twice the size.
+	block := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(block)
+	body := append(block, block...)
+	sizes := make(map[int]int)
+	for _, lgwin := range []int{0, 10} {
+		var got bytes.Buffer
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.Copy(&got, r.Body) }))
+		client := &http.Client{Transport: &compressmw.Transport{Encoding: "br", BrotliWindow: lgwin}}
+		resp, err := client.Post(s.URL, "application/octet-stream", bytes.NewReader(body))
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		sizes[lgwin] = got.Len()
+		if b, err := decode("br", &got); err != nil || b != string(body) {
+			t.Errorf("window %d: upload didn't decompress: %v", lgwin, err)
+		}
+
+		cp, err := compressmw.NewCompressor(compressmw.WithEncodings("br"), compressmw.WithBrotliWindow(lgwin))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Accept-Encoding", "br")
+		rec := httptest.NewRecorder()
+		cp.Handler(echo).ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") != "br" {
+			t.Errorf("window %d: Compressor sent Content-Encoding %q, want br", lgwin, rec.Header().Get("Content-Encoding"))
+		}
+		if n := rec.Body.Len(); n < sizes[lgwin]*9/10 || n > sizes[lgwin]*11/10 {
+			t.Errorf("window %d: Compressor sent %d bytes, but Transport sent %d", lgwin, n, sizes[lgwin])
+		}
+	}
+	if sizes[10] < 2*len(block) || sizes[0] > len(block)+len(block)/10 {
+		t.Errorf("got %d bytes with the default window and %d with a 1 KiB window, for %d bytes repeated", sizes[0], sizes[10], len(block))
+	}
+	if _, err := compressmw.NewCompressor(compressmw.WithEncodings("br"), compressmw.WithBrotliWindow(25)); err == nil {
+		t.Error("NewCompressor: got no error for a window of 2^25")
+	}
+	if _, err := compressmw.NewTransport(compressmw.WithLevel("br", 0), compressmw.WithBrotliWindow(9)); err == nil {
+		t.Error("NewTransport: got no error for a window of 2^9")
+	}
+}
+
+func TestDeflate(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	s := httptest.NewServer(compressmw.ServerAcceptDeflate(compressmw.ServerDeflateResponseBody(echo, 0)))
+	t.Cleanup(s.Close)
+
+	// what we send is zlib-wrapped, and so is what we get back.
+	var sent bytes.Buffer
+	client := &http.Client{Transport: compressmw.ClientDeflateBody(roundtripfunc(func(r *http.Request) (*http.Response, error) {
+		body, _ := r.GetBody()
+		io.Copy(&sent, body)
+		r.Header.Set("Accept-Encoding", "deflate")
+		return http.DefaultTransport.RoundTrip(r)
+	}), 9)}
+	resp, err := client.Post(s.URL, "text/plain", strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, err := decode("deflate", &sent); err != nil || got != want {
+		t.Errorf("request body: got %q, %v", got, err)
+	}
+	if resp.Header.Get("Content-Encoding") != "deflate" {
+		t.Fatalf("got Content-Encoding %q, want deflate", resp.Header.Get("Content-Encoding"))
+	}
+	if got, err := decode("deflate", resp.Body); err != nil || got != want {
+		t.Errorf("response body: got %q, %v", got, err)
+	}
+
+	// older clients send raw deflate under the same name.
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	io.WriteString(fw, want)
+	fw.Close()
+	req := httptest.NewRequest("POST", "/", &raw)
+	req.Header.Set("Content-Encoding", "deflate")
+	rec := httptest.NewRecorder()
+	compressmw.ServerAcceptDeflate(echo).ServeHTTP(rec, req)
+	if rec.Body.String() != want {
+		t.Errorf("raw deflate request: got %q, want %q", rec.Body, want)
+	}
+
+	// and so do older servers.
+	rawServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		fw, _ := flate.NewWriter(w, flate.BestSpeed)
+		io.WriteString(fw, want)
+		fw.Close()
+	}))
+	t.Cleanup(rawServer.Close)
+	resp, err = (&http.Client{Transport: compressmw.ClientAcceptCompressed(http.DefaultTransport, "gzip", "deflate")}).Get(rawServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, err := io.ReadAll(resp.Body); err != nil || string(got) != want || !resp.Uncompressed {
+		t.Errorf("raw deflate response: got %q, %v (uncompressed %v), want %q", got, err, resp.Uncompressed, want)
+	}
+}
+
+// flateCodec is a minimal compressmw.Codec for testing Register: raw DEFLATE under a made-up token.
+type flateCodec struct{}
+
+func (flateCodec) Name() string                         { return "x-test-flate" }
+func (flateCodec) Aliases() []string                    { return []string{"x-test-flate-alias"} }
+func (flateCodec) Levels() (min, max, def int)          { return flate.BestSpeed, flate.BestCompression, 5 }
+func (flateCodec) NewReader() compressmw.Decoder        { return &flateReader{flate.NewReader(nil)} }
+func (flateCodec) NewWriter(lvl int) compressmw.Encoder { w, _ := flate.NewWriter(nil, lvl); return w }
+
+type flateReader struct{ io.ReadCloser }
+
+func (f *flateReader) Reset(r io.Reader) error { return f.ReadCloser.(flate.Resetter).Reset(r, nil) }
+
+func init() { compressmw.Register(flateCodec{}) }
+
+func TestRegisteredCodec(t *testing.T) {
+	t.Parallel()
+	if _, ok := compressmw.Lookup("X-Test-Flate-Alias"); !ok {
+		t.Fatal("Lookup: registered codec not found by alias")
+	}
+	const want = "<this is the body>"
+	// decode any registered encoding, then re-encode the response with ours.
+	handler := compressmw.ServerCompressResponseBody(compressmw.ServerAcceptCompressed(echo), "x-test-flate", 9)
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+	client := &http.Client{Transport: compressmw.ClientCompressBody(http.DefaultTransport, "x-test-flate", 0)}
+	req, err := http.NewRequest("POST", s.URL+"/foo", strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "x-test-flate-alias")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "x-test-flate" {
+		t.Errorf("got Content-Encoding %q, want %q", got, "x-test-flate")
+	}
+	b, err := io.ReadAll(flate.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+// levelsCodec is flateCodec with other Levels.
+type levelsCodec struct {
+	flateCodec
+	min, max, def int
+}
+
+func (c levelsCodec) Name() string                { return fmt.Sprintf("x-test-levels-%d-%d-%d", c.min, c.max, c.def) }
+func (levelsCodec) Aliases() []string             { return nil }
+func (c levelsCodec) Levels() (min, max, def int) { return c.min, c.max, c.def }
+
+func TestRegisterInvalidLevels(t *testing.T) {
+	t.Parallel()
+	for _, c := range []levelsCodec{
+		{min: flate.HuffmanOnly, max: flate.BestCompression, def: flate.DefaultCompression}, // 0 and -1 mean the default.
+		{min: 0, max: 9, def: 6},
+		{min: 5, max: 1, def: 3},
+		{min: 1, max: 9, def: 10},
+	} {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); err == nil || !strings.Contains(err.Error(), "invalid levels") {
+					t.Errorf("%s: got panic %v, want invalid levels", c.Name(), err)
+				}
+			}()
+			compressmw.Register(c)
+		}()
+	}
+}
+
+func TestCompressUnknownEncodingPanics(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for an unregistered encoding")
+		}
+	}()
+	compressmw.ServerCompressResponseBody(echo, "x-not-registered", 0)
+}
+
+func TestServerRefusedGzip(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	for _, accept := range []string{"gzip;q=0", "identity;q=1, gzip;q=0.5", "br"} {
+		req, err := http.NewRequest("POST", "/foo", strings.NewReader(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", accept)
+		rec := httptest.NewRecorder()
+		compressmw.ServerGzipResponseBody(echo, 0).ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want none", accept, got)
+		}
+		if got := rec.Body.String(); got != want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressorNegotiates(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	cp := &compressmw.Compressor{Encodings: []string{"zstd", "br", "gzip"}, Levels: map[string]int{"gzip": 9}}
+	for accept, wantEncoding := range map[string]string{
+		"gzip, br, zstd":       "zstd",
+		"gzip, br;q=0.9":       "gzip",
+		"zstd;q=0, *;q=0.5":    "br",
+		"deflate, identity":    "",
+		"identity;q=0, x-gzip": "gzip",
+	} {
+		for name, h := range map[string]http.Handler{"net/http": cp.Handler(echo), "gin": ginEcho(cp.Gin())} {
+			req, err := http.NewRequest("POST", "/foo", strings.NewReader(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", accept)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Content-Encoding"); got != wantEncoding {
+				t.Errorf("%s: Accept-Encoding %q: got Content-Encoding %q, want %q", name, accept, got, wantEncoding)
+			}
+			if got, err := decode(wantEncoding, rec.Body); err != nil {
+				t.Errorf("%s: Accept-Encoding %q: error reading response body: %v", name, accept, err)
+			} else if got != want {
+				t.Errorf("%s: Accept-Encoding %q: got %q, want %q", name, accept, got, want)
+			}
+		}
+	}
+}
+
+// ginEcho is a gin router that echoes POST /foo through the given middleware.
+func ginEcho(middleware ...gin.HandlerFunc) *gin.Engine {
+	router := gin.New()
+	router.Use(middleware...)
+	router.POST("/foo", func(c *gin.Context) {
+		io.Copy(c.Writer, c.Request.Body)
+	})
+	return router
+}
+
+// decode decompresses all of r according to the content-coding encoding: "" is identity.
+func decode(encoding string, r io.Reader) (string, error) {
+	dec, err := decoder(encoding, r)
+	if err != nil {
+		return "", err
+	}
+	defer dec.Close()
+	b, err := io.ReadAll(dec)
+	return string(b), err
+}
+
+// decoder returns a streaming reader for the content-coding encoding: "" is identity.
+func decoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+func TestCompressorMinSize(t *testing.T) {
+	t.Parallel()
+	cp := &compressmw.Compressor{Encodings: []string{"gzip"}, MinSize: 64}
+	// write the body a few bytes at a time, so the threshold is crossed mid-stream.
+	var chunked http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		for len(b) > 0 {
+			n := min(len(b), 10)
+			w.Write(b[:n])
+			b = b[n:]
+		}
+	}
+	for _, tt := range []struct {
+		name, body   string
+		wantEncoding string
+	}{
+		{name: "small", body: "ok", wantEncoding: ""},
+		{name: "empty", body: "", wantEncoding: ""},
+		{name: "just under", body: strings.Repeat("a", 63), wantEncoding: ""},
+		{name: "at threshold", body: strings.Repeat("a", 64), wantEncoding: "gzip"},
+		{name: "large", body: strings.Repeat("<this is the body>", 100), wantEncoding: "gzip"},
+	} {
+		for name, h := range map[string]http.Handler{"net/http": cp.Handler(chunked), "gin": ginEcho(cp.Gin())} {
+			req, err := http.NewRequest("POST", "/foo", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if name == "net/http" && rec.Code != http.StatusAccepted {
+				t.Errorf("%s/%s: got status %d, want %d", name, tt.name, rec.Code, http.StatusAccepted)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("%s/%s: got Content-Encoding %q, want %q", name, tt.name, got, tt.wantEncoding)
+			}
+			if tt.wantEncoding == "" {
+				if got, want := rec.Header().Get("Content-Length"), fmt.Sprint(len(tt.body)); got != want {
+					t.Errorf("%s/%s: got Content-Length %q, want %q", name, tt.name, got, want)
+				}
+			}
+			if got, err := decode(tt.wantEncoding, rec.Body); err != nil {
+				t.Errorf("%s/%s: error reading response body: %v", name, tt.name, err)
+			} else if got != tt.body {
+				t.Errorf("%s/%s: got %q, want %q", name, tt.name, got, tt.body)
+			}
+		}
+	}
+}
+
+func TestCompressorContentTypes(t *testing.T) {
+	t.Parallel()
+	const body = "<html><body>this is the body</body></html>"
+	for _, tt := range []struct {
+		name         string
+		cp           *compressmw.Compressor
+		contentType  string // set by the handler, if non-empty
+		encoding     string // set by the handler, if non-empty
+		wantEncoding string
+		wantType     string
+	}{
+		{name: "sniffed", cp: &compressmw.Compressor{Encodings: []string{"gzip"}}, wantEncoding: "gzip", wantType: "text/html; charset=utf-8"},
+		{name: "default excludes png", cp: &compressmw.Compressor{Encodings: []string{"gzip"}}, contentType: "image/png", wantType: "image/png"},
+		{name: "allowed", cp: &compressmw.Compressor{Encodings: []string{"gzip"}, ContentTypes: []string{"text/*"}}, contentType: "text/csv", wantEncoding: "gzip", wantType: "text/csv"},
+		{name: "not allowed", cp: &compressmw.Compressor{Encodings: []string{"gzip"}, ContentTypes: []string{"text/*"}}, contentType: "application/json", wantType: "application/json"},
+		{name: "already encoded", cp: &compressmw.Compressor{Encodings: []string{"gzip"}}, contentType: "text/plain", encoding: "br", wantEncoding: "br", wantType: "text/plain"},
+	} {
+		var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType != "" {
+				w.Header().Set("Content-Type", tt.contentType)
+			}
+			if tt.encoding != "" {
+				w.Header().Set("Content-Encoding", tt.encoding)
+			}
+			io.WriteString(w, body)
+		}
+		router := gin.New()
+		router.Use(tt.cp.Gin())
+		router.GET("/foo", gin.WrapF(handler))
+		for name, h := range map[string]http.Handler{"net/http": tt.cp.Handler(handler), "gin": router} {
+			req, err := http.NewRequest("GET", "/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("%s/%s: got Content-Encoding %q, want %q", name, tt.name, got, tt.wantEncoding)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("%s/%s: got Content-Type %q, want %q", name, tt.name, got, tt.wantType)
+			}
+			wantEncoding := tt.wantEncoding
+			if wantEncoding == tt.encoding {
+				wantEncoding = "" // the handler "encoded" it, and we left it alone.
+			}
+			if got, err := decode(wantEncoding, rec.Body); err != nil {
+				t.Errorf("%s/%s: error reading response body: %v", name, tt.name, err)
+			} else if got != body {
+				t.Errorf("%s/%s: got %q, want %q", name, tt.name, got, body)
+			}
+		}
+	}
+}
+
+func TestCompressorBodilessResponses(t *testing.T) {
+	t.Parallel()
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/204":
+			w.WriteHeader(http.StatusNoContent)
+		case "/304":
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "<this is the body>")
+		}
+	}
+	cp := &compressmw.Compressor{Encodings: []string{"gzip"}}
+	router := gin.New()
+	router.Use(cp.Gin())
+	router.Any("/*path", gin.WrapF(handler))
+	for name, h := range map[string]http.Handler{"net/http": cp.Handler(handler), "gin": router} {
+		s := httptest.NewServer(h)
+		t.Cleanup(s.Close)
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		for _, tt := range []struct{ method, path string }{{"GET", "/204"}, {"GET", "/304"}, {"HEAD", "/body"}} {
+			req, err := http.NewRequest(tt.method, s.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("%s: %s %s: got Content-Encoding %q, want none", name, tt.method, tt.path, got)
+			}
+			if len(b) != 0 {
+				t.Errorf("%s: %s %s: got body %q, want none", name, tt.method, tt.path, b)
+			}
+		}
+	}
+}
+
+func TestCompressorEarlyHints(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, want)
+	}
+	s := httptest.NewServer(compressmw.ServerGzipResponseBody(handler, 0))
+	t.Cleanup(s.Close)
+	var hints []int
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+		hints = append(hints, code)
+		return nil
+	}}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Client{Transport: &http.Transport{DisableCompression: true}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(hints) != 1 || hints[0] != http.StatusEarlyHints {
+		t.Errorf("got informational responses %v, want [103]", hints)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if got, err := decode(resp.Header.Get("Content-Encoding"), resp.Body); err != nil {
+		t.Errorf("error reading response body: %v", err)
+	} else if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCompressorHeaderHygiene(t *testing.T) {
+	t.Parallel()
+	const body = "<this is the body>"
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Vary", "Origin")
+		io.WriteString(w, body)
+	}
+	cp := &compressmw.Compressor{Encodings: []string{"gzip"}}
+	router := gin.New()
+	router.Use(cp.Gin())
+	router.GET("/foo", gin.WrapF(handler))
+	for name, h := range map[string]http.Handler{"net/http": cp.Handler(handler), "gin": router} {
+		for _, accept := range []string{"gzip", ""} {
+			req, err := http.NewRequest("GET", "/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accept != "" {
+				req.Header.Set("Accept-Encoding", accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got := rec.Header().Values("Vary"); !slices.Contains(got, "Accept-Encoding") || !slices.Contains(got, "Origin") {
+				t.Errorf("%s: Accept-Encoding %q: got Vary %q, want Origin and Accept-Encoding", name, accept, got)
+			}
+			wantLength, wantETag := fmt.Sprint(len(body)), `"v1"`
+			if accept != "" {
+				wantLength, wantETag = "", `W/"v1"`
+			}
+			if got := rec.Header().Get("Content-Length"); got != wantLength {
+				t.Errorf("%s: Accept-Encoding %q: got Content-Length %q, want %q", name, accept, got, wantLength)
+			}
+			if got := rec.Header().Get("ETag"); got != wantETag {
+				t.Errorf("%s: Accept-Encoding %q: got ETag %q, want %q", name, accept, got, wantETag)
+			}
+		}
+	}
+}
+
+func TestDecompressorLimits(t *testing.T) {
+	t.Parallel()
+	zeros := func(n int) []byte { // gzip-compressed n zero bytes: about as bomb-like as it gets.
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(make([]byte, n))
+		gw.Close()
+		return buf.Bytes()
+	}
+	for _, tt := range []struct {
+		name   string
+		d      *compressmw.Decompressor
+		body   []byte
+		wantOK bool
+	}{
+		{name: "no limits", d: &compressmw.Decompressor{}, body: zeros(4 << 20), wantOK: true},
+		{name: "under MaxSize", d: &compressmw.Decompressor{MaxSize: 1000}, body: zeros(1000), wantOK: true},
+		{name: "over MaxSize", d: &compressmw.Decompressor{MaxSize: 1000}, body: zeros(1001)},
+		{name: "small but high ratio", d: &compressmw.Decompressor{MaxRatio: 10}, body: zeros(1 << 10), wantOK: true},
+		{name: "over MaxRatio", d: &compressmw.Decompressor{MaxRatio: 100}, body: zeros(4 << 20)},
+	} {
+		var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			n, err := io.Copy(io.Discard, r.Body)
+			var tooLarge *compressmw.TooLargeError
+			switch {
+			case errors.As(err, &tooLarge):
+				if tt.d.MaxSize > 0 && n != tt.d.MaxSize {
+					t.Errorf("%s: read %d bytes before the error, want %d", tt.name, n, tt.d.MaxSize)
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case err != nil:
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+		}
+		req, err := http.NewRequest("POST", "/foo", bytes.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		tt.d.Handler(handler).ServeHTTP(rec, req)
+		if gotOK := rec.Code == http.StatusOK; gotOK != tt.wantOK {
+			t.Errorf("%s: got status %d: %s", tt.name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestZstdWindow(t *testing.T) {
+	t.Parallel()
+	// a frame declaring a 512 MiB window (no content size, so the decoder can't size it down) around a 5-byte raw block.
+	frame := []byte("\x28\xb5\x2f\xfd\x00\x98\x29\x00\x00hello")
+	var called bool
+	h := (&compressmw.Decompressor{MaxSize: 1 << 10, RejectTooLarge: true}).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(frame))
+	req.Header.Set("Content-Encoding", "zstd")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || called {
+		t.Errorf("request: got status %d (handler called: %v), want %d", rec.Code, called, http.StatusBadRequest)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Write(frame)
+	}))
+	t.Cleanup(s.Close)
+	resp, err := (&http.Client{Transport: &compressmw.DecompressTransport{}}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("response: got %q, want an error", b)
+	}
+}
+
+func TestDecompressorRejectTooLarge(t *testing.T) {
+	t.Parallel()
+	var body bytes.Buffer
+	gw := gzip.NewWriter(&body)
+	gw.Write(make([]byte, 1<<16))
+	gw.Close()
+
+	d := &compressmw.Decompressor{MaxSize: 1 << 10, RejectTooLarge: true}
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			// a typical handler: this should never reach the client.
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "ok")
+	}
+	router := gin.New()
+	router.Use(d.Gin())
+	router.POST("/foo", gin.WrapF(handler))
+	for name, h := range map[string]http.Handler{"net/http": d.Handler(handler), "gin": router} {
+		req, err := http.NewRequest("POST", "/foo", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: got status %d, want %d", name, rec.Code, http.StatusRequestEntityTooLarge)
+		}
+		if got := rec.Body.String(); strings.Contains(got, "bad request") {
+			t.Errorf("%s: the handler's response leaked into the 413: %q", name, got)
+		}
+	}
+
+	// the handler can still stream its response, or take over the connection.
+	s := httptest.NewServer(d.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("the ResponseWriter isn't an http.Flusher")
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("the ResponseWriter isn't an http.Hijacker")
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		brw.Flush()
+	})))
+	t.Cleanup(s.Close)
+	resp, err := s.Client().Post(s.URL, "text/plain", strings.NewReader("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hijacked" {
+		t.Errorf("got %q, want %q", b, "hijacked")
+	}
+}
+
+func TestDecompressorMalformedBody(t *testing.T) {
+	t.Parallel()
+	var called bool
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		io.Copy(w, r.Body)
+	}
+	for _, encoding := range []string{"gzip", "zstd"} {
+		// the default: 400 Bad Request.
+		req, err := http.NewRequest("POST", "/foo", strings.NewReader("<this is not compressed>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		compressmw.ServerAcceptCompressed(handler).ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", encoding, rec.Code, http.StatusBadRequest)
+		}
+		if called {
+			t.Errorf("%s: the handler shouldn't see a malformed body", encoding)
+		}
+
+		// a custom ErrorHandler gets a *DecodeError.
+		var gotErr error
+		d := &compressmw.Decompressor{ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			gotErr = err
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		}}
+		router := gin.New()
+		router.Use(d.Gin(), func(c *gin.Context) {
+			c.Next()
+			if len(c.Errors) == 0 {
+				t.Errorf("%s: gin: no error recorded in c.Errors", encoding)
+			}
+		})
+		router.POST("/foo", gin.WrapF(handler))
+		for name, h := range map[string]http.Handler{"net/http": d.Handler(handler), "gin": router} {
+			gotErr = nil
+			req, err := http.NewRequest("POST", "/foo", strings.NewReader("<this is not compressed>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Encoding", encoding)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("%s: %s: got status %d, want %d", encoding, name, rec.Code, http.StatusUnsupportedMediaType)
+			}
+			var decodeErr *compressmw.DecodeError
+			if !errors.As(gotErr, &decodeErr) || decodeErr.Encoding != encoding {
+				t.Errorf("%s: %s: got error %v, want a *DecodeError for %s", encoding, name, gotErr, encoding)
+			}
+		}
+		if called {
+			t.Errorf("%s: the handler shouldn't see a malformed body", encoding)
+		}
+	}
+}
+
+func TestDecompressorStacked(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	// encode applies codings in order, as Content-Encoding lists them.
+	encode := func(codings ...string) []byte {
+		b := []byte(want)
+		for _, coding := range codings {
+			var buf bytes.Buffer
+			var w io.WriteCloser
+			switch coding {
+			case "gzip":
+				w = gzip.NewWriter(&buf)
+			case "br":
+				w = brotli.NewWriter(&buf)
+			case "zstd":
+				w, _ = zstd.NewWriter(&buf)
+			}
+			w.Write(b)
+			w.Close()
+			b = buf.Bytes()
+		}
+		return b
+	}
+	var called bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if ce := r.Header.Values("Content-Encoding"); len(ce) > 0 && ce[0] != "identity" { // there's nothing to remove from an identity body.
+			t.Errorf("the handler saw Content-Encoding %q", ce)
+		}
+		io.Copy(w, r.Body)
+	})
+	strict := &compressmw.Decompressor{Encodings: []string{"gzip", "br"}, RejectUnsupported: true}
+	router := gin.New()
+	router.Use(strict.Gin())
+	router.POST("/", gin.WrapF(handler))
+	for _, tt := range []struct {
+		header []string // Content-Encoding
+		body   []byte
+		code   int
+		accept string // the 415's Accept-Encoding
+	}{
+		{header: []string{"gzip, br"}, body: encode("gzip", "br"), code: http.StatusOK},
+		{header: []string{"br", "gzip"}, body: encode("br", "gzip"), code: http.StatusOK},
+		{header: []string{"gzip", "gzip"}, body: encode("gzip", "gzip"), code: http.StatusOK},
+		{header: []string{"x-gzip,identity, , BR"}, body: encode("gzip", "br"), code: http.StatusOK},
+		{header: []string{"identity"}, body: []byte(want), code: http.StatusOK},
+		{header: []string{"br, gzip"}, body: encode("gzip", "br"), code: http.StatusBadRequest}, // the wrong order.
+		{header: []string{"gzip, zstd"}, body: encode("gzip", "zstd"), code: http.StatusUnsupportedMediaType, accept: "gzip, br"},
+		{header: []string{"zstd", "br"}, body: encode("zstd", "br"), code: http.StatusUnsupportedMediaType, accept: "gzip, br"},
+	} {
+		for name, h := range map[string]http.Handler{"net/http": strict.Handler(handler), "gin": router} {
+			called = false
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(tt.body))
+			req.Header["Content-Encoding"] = tt.header
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			switch {
+			case rec.Code != tt.code:
+				t.Errorf("%s: %q: got status %d (%s), want %d", name, tt.header, rec.Code, rec.Body, tt.code)
+			case tt.code == http.StatusOK && rec.Body.String() != want:
+				t.Errorf("%s: %q: got %q, want %q", name, tt.header, rec.Body, want)
+			case tt.code != http.StatusOK && called:
+				t.Errorf("%s: %q: the handler was called", name, tt.header)
+			case rec.Header().Get("Accept-Encoding") != tt.accept:
+				t.Errorf("%s: %q: got Accept-Encoding %q, want %q", name, tt.header, rec.Header().Get("Accept-Encoding"), tt.accept)
+			}
+		}
+	}
+
+	// middleware that doesn't own the header decodes the layers it can, from the end, and leaves the rest for the next,
+	// unless nothing could decode the rest: a layer it decodes stuck beneath one it can't, or an unregistered coding.
+	ginGzip := gin.New()
+	ginGzip.Use(compressmw.GinAcceptGzip)
+	ginGzip.POST("/", gin.WrapF(handler))
+	for _, tt := range []struct {
+		header []string
+		body   []byte
+		code   int
+	}{
+		{[]string{"zstd"}, encode("zstd"), http.StatusOK},
+		{[]string{"gzip"}, encode("gzip"), http.StatusOK},
+		{[]string{"zstd, gzip"}, encode("zstd", "gzip"), http.StatusOK},
+		{[]string{"zstd", "gzip", "gzip"}, encode("zstd", "gzip", "gzip"), http.StatusOK},
+		{[]string{"gzip, zstd"}, encode("gzip", "zstd"), http.StatusUnsupportedMediaType}, // ServerAcceptZstd would leave gzip for the handler.
+		{[]string{"gzip, br"}, encode("gzip", "br"), http.StatusUnsupportedMediaType},
+		{[]string{"gzip", "compress"}, encode("gzip"), http.StatusUnsupportedMediaType},
+	} {
+		for name, h := range map[string]http.Handler{
+			"composed": compressmw.ServerAcceptGzip(compressmw.ServerAcceptZstd(handler)),
+			"gin":      ginGzip,
+		} {
+			if name == "gin" && strings.Contains(strings.Join(tt.header, ","), "zstd") { // GinAcceptGzip alone, nothing to take the zstd.
+				continue
+			}
+			called = false
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(tt.body))
+			req.Header["Content-Encoding"] = tt.header
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			switch {
+			case rec.Code != tt.code || (tt.code == http.StatusOK) != called:
+				t.Errorf("%s: %q: got %d (handler called: %v), want %d", name, tt.header, rec.Code, called, tt.code)
+			case tt.code == http.StatusOK && rec.Body.String() != want:
+				t.Errorf("%s: %q: got %q, want %q", name, tt.header, rec.Body, want)
+			case tt.code != http.StatusOK && rec.Header().Get("Accept-Encoding") != "gzip":
+				t.Errorf("%s: %q: got Accept-Encoding %q, want gzip", name, tt.header, rec.Header().Get("Accept-Encoding"))
+			}
+		}
+	}
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(encode("zstd", "gzip")))
+	req.Header.Set("Content-Encoding", "zstd, gzip")
+	compressmw.ServerAcceptGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ce := r.Header.Get("Content-Encoding"); ce != "zstd" {
+			t.Errorf("ServerAcceptGzip: left Content-Encoding %q, want %q", ce, "zstd")
+		}
+		if got, err := decode("zstd", r.Body); err != nil || got != want {
+			t.Errorf("ServerAcceptGzip: left %q, %v, want zstd of %q", got, err, want)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	// a custom ErrorHandler gets an *UnsupportedEncodingError, and the Accept-Encoding header is already set.
+	var gotErr error
+	d := &compressmw.Decompressor{RejectUnsupported: true, ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		w.WriteHeader(http.StatusTeapot)
+	}}
+	req = httptest.NewRequest("POST", "/", strings.NewReader(want))
+	req.Header.Set("Content-Encoding", "compress")
+	rec := httptest.NewRecorder()
+	d.Handler(handler).ServeHTTP(rec, req)
+	var unsupported *compressmw.UnsupportedEncodingError
+	if !errors.As(gotErr, &unsupported) || unsupported.Encoding != "compress" || rec.Code != http.StatusTeapot {
+		t.Errorf("custom ErrorHandler: got %v, status %d", gotErr, rec.Code)
+	}
+	if accept := rec.Header().Get("Accept-Encoding"); !strings.Contains(accept, "deflate") || !strings.Contains(accept, "zstd") {
+		t.Errorf("any registered codec: got Accept-Encoding %q, want all of them", accept)
+	}
+	req = httptest.NewRequest("POST", "/", strings.NewReader(want))
+	req.Header.Set("Content-Encoding", "compress")
+	rec = httptest.NewRecorder()
+	compressmw.ServerAcceptCompressed(handler).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("ServerAcceptCompressed(): got status %d for an unregistered coding, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+
+	// limits apply to what the handler reads, after every layer.
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(encode("gzip", "br")))
+	req.Header.Set("Content-Encoding", "gzip, br")
+	rec = httptest.NewRecorder()
+	(&compressmw.Decompressor{MaxSize: 4, RejectTooLarge: true}).Handler(handler).ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("MaxSize: got status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// a Transport that sends zstd to a gzip-only server learns from the 415, and retries with gzip.
+	s := httptest.NewServer((&compressmw.Decompressor{Encodings: []string{"gzip"}, RejectUnsupported: true}).Handler(handler))
+	t.Cleanup(s.Close)
+	resp, err := (&http.Client{Transport: &compressmw.Transport{Encoding: "zstd"}}).Post(s.URL, "text/plain", strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(b) != want {
+		t.Errorf("Transport: got %d, %q, want 200, %q", resp.StatusCode, b, want)
+	}
+}
+
+// errReader reads n bytes of 'a', then fails with err.
+type errReader struct {
+	n   int
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	n := min(len(p), r.n)
+	for i := range p[:n] {
+		p[i] = 'a'
+	}
+	r.n -= n
+	return n, nil
+}
+
+func TestTransportStream(t *testing.T) {
+	t.Parallel()
+	s := httptest.NewServer(compressmw.ServerAcceptCompressed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d %d %s", n, r.ContentLength, r.TransferEncoding)
+	})))
+	t.Cleanup(s.Close)
+
+	for _, encoding := range []string{"gzip", "zstd", "br"} {
+		// a large body streams through, chunked.
+		const size = 8 << 20
+		client := &http.Client{Transport: &compressmw.Transport{Encoding: encoding, Stream: true}}
+		body := &errReader{n: size, err: io.EOF}
+		resp, err := client.Post(s.URL, "application/octet-stream", body)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := fmt.Sprintf("%d -1 [chunked]", size); string(b) != want {
+			t.Errorf("%s: got %q, want %q", encoding, b, want)
+		}
+
+		// an error reading the body comes back from RoundTrip.
+		errBroken := errors.New("broken body")
+		_, err = client.Post(s.URL, "application/octet-stream", &errReader{n: 1 << 20, err: errBroken})
+		if !errors.Is(err, errBroken) {
+			t.Errorf("%s: got error %v, want %v", encoding, err, errBroken)
+		}
+	}
+
+	// cancelling the context stops an upload that would otherwise block forever.
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		pw.Write(make([]byte, 1<<10))
+		cancel()
+	}()
+	client := &http.Client{Transport: &compressmw.Transport{Stream: true}}
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// if the base transport fails without reading the body, RoundTrip doesn't wait for a body that never sends another byte.
+	errDial := errors.New("dial failed")
+	base := roundtripfunc(func(r *http.Request) (*http.Response, error) { return nil, errDial })
+	pr, pw = io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	done := make(chan error, 1)
+	go func() {
+		_, err := (&compressmw.Transport{Base: base, Stream: true}).RoundTrip(httptest.NewRequest("POST", "http://example.com", pr))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errDial) {
+			t.Errorf("base error: got %v, want %v", err, errDial)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RoundTrip blocked on the body after the base transport failed")
+	}
+	if _, err := pw.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("writing the body after RoundTrip: got %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestTransportGetBody(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	mux := http.NewServeMux()
+	mux.Handle("/echo", compressmw.ServerAcceptGzip(echo))
+	mux.Handle("/redirect", http.RedirectHandler("/echo", http.StatusTemporaryRedirect))
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	for _, stream := range []bool{false, true} {
+		// 307 and 308 redirects replay the body.
+		client := &http.Client{Transport: &compressmw.Transport{Stream: stream}}
+		resp, err := client.Post(s.URL+"/redirect", "text/plain", strings.NewReader(want))
+		if err != nil {
+			t.Fatalf("stream=%v: %v", stream, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != want {
+			t.Errorf("stream=%v: redirect: got %q, want %q", stream, b, want)
+		}
+
+		// the base transport can replay the compressed body, even after RoundTrip returns.
+		var sent *http.Request
+		base := roundtripfunc(func(r *http.Request) (*http.Response, error) {
+			sent = r
+			io.Copy(io.Discard, r.Body)
+			r.Body.Close()
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+		})
+		client = &http.Client{Transport: &compressmw.Transport{Base: base, Stream: stream}}
+		resp, err = client.Post("http://example.com", "text/plain", strings.NewReader(want))
+		if err != nil {
+			t.Fatalf("stream=%v: %v", stream, err)
+		}
+		resp.Body.Close()
+		for i := 0; i < 2; i++ {
+			body, err := sent.GetBody()
+			if err != nil {
+				t.Fatalf("stream=%v: GetBody: %v", stream, err)
+			}
+			got, err := decode("gzip", body)
+			body.Close()
+			if err != nil || got != want {
+				t.Errorf("stream=%v: GetBody #%d: got %q, %v, want %q", stream, i, got, err, want)
+			}
+		}
+	}
+}
+
+type roundtripfunc func(*http.Request) (*http.Response, error)
+
+func (rt roundtripfunc) RoundTrip(r *http.Request) (*http.Response, error) { return rt(r) }
+
+func TestDecompressTransport(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the response body>"
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, want)
+	}
+	for _, encoding := range []string{"gzip", "zstd", "br"} {
+		s := httptest.NewServer(compressmw.ServerCompressResponseBody(handler, encoding, 0))
+		t.Cleanup(s.Close)
+
+		client := &http.Client{Transport: compressmw.ClientAcceptCompressed(http.DefaultTransport)}
+		resp, err := client.Get(s.URL)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", encoding, b, err, want)
+		}
+		if !resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1 {
+			t.Errorf("%s: got Uncompressed %v, Content-Encoding %q, ContentLength %d: want true, \"\", -1",
+				encoding, resp.Uncompressed, resp.Header.Get("Content-Encoding"), resp.ContentLength)
+		}
+
+		// a caller that sets its own Accept-Encoding gets the body as sent.
+		req, err := http.NewRequest("GET", s.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		got, err := decode(resp.Header.Get("Content-Encoding"), resp.Body)
+		resp.Body.Close()
+		if err != nil || got != want || resp.Header.Get("Content-Encoding") != encoding {
+			t.Errorf("%s: own Accept-Encoding: got %q, %q, %v, want %q", encoding, resp.Header.Get("Content-Encoding"), got, err, want)
+		}
+	}
+
+	// a body that isn't what its Content-Encoding claims fails on Read.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		io.WriteString(w, "<this is not compressed>")
+	}))
+	t.Cleanup(s.Close)
+	resp, err := (&http.Client{Transport: &compressmw.DecompressTransport{}}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("got no error reading a malformed zstd body")
+	}
+}
+
+func TestTransportFallback(t *testing.T) {
+	t.Parallel()
+	const want = "<this is the body>"
+	// a server that only takes the content-codings in its accept header, and says so in its 415s.
+	server := func(accept string) (s *httptest.Server, encodings *[]string) {
+		encodings = new([]string)
+		var mu sync.Mutex
+		s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ce := r.Header.Get("Content-Encoding")
+			mu.Lock()
+			*encodings = append(*encodings, ce)
+			mu.Unlock()
+			if ce != "" && !strings.Contains(accept, ce) {
+				w.Header().Set("Accept-Encoding", accept)
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			got, err := decode(ce, r.Body)
+			if err != nil || got != want {
+				http.Error(w, fmt.Sprintf("got %q, %v", got, err), http.StatusBadRequest)
+			}
+		}))
+		t.Cleanup(s.Close)
+		return s, encodings
+	}
+
+	for _, tt := range []struct {
+		accept string
+		want   []string // the Content-Encoding of each request the server sees
+	}{
+		{accept: "", want: []string{"gzip", "", ""}},
+		{accept: "zstd", want: []string{"gzip", "zstd", "zstd"}},
+		{accept: "identity", want: []string{"gzip", "", ""}},
+	} {
+		for _, stream := range []bool{false, true} {
+			s, encodings := server(tt.accept)
+			client := &http.Client{Transport: &compressmw.Transport{Stream: stream}}
+			for i := 0; i < 2; i++ {
+				resp, err := client.Post(s.URL, "text/plain", strings.NewReader(want))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("accept %q, stream=%v: request %d: got status %d, want %d", tt.accept, stream, i, resp.StatusCode, http.StatusOK)
+				}
+			}
+			if !slices.Equal(*encodings, tt.want) {
+				t.Errorf("accept %q, stream=%v: server saw %q, want %q", tt.accept, stream, *encodings, tt.want)
+			}
+		}
+	}
+
+	// the buffered Transport can retry bodies without a GetBody, too.
+	s, encodings := server("")
+	client := &http.Client{Transport: &compressmw.Transport{}}
+	resp, err := client.Post(s.URL, "text/plain", io.MultiReader(strings.NewReader(want)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !slices.Equal(*encodings, []string{"gzip", ""}) {
+		t.Errorf("no GetBody: got status %d, server saw %q", resp.StatusCode, *encodings)
+	}
+
+	// if the server accepts the coding after all, the 415 is about something else: pass it on.
+	s, encodings = server("gzip")
+	client = &http.Client{Transport: &compressmw.Transport{Encoding: "zstd"}}
+	resp, err = client.Post(s.URL, "text/plain", strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !slices.Equal(*encodings, []string{"zstd", "gzip"}) {
+		t.Errorf("zstd to a gzip server: got status %d, server saw %q", resp.StatusCode, *encodings)
+	}
+
+	// DisableFallback passes the 415 on; learned codings expire after FallbackTTL.
+	s, encodings = server("")
+	client = &http.Client{Transport: &compressmw.Transport{DisableFallback: true}}
+	resp, err = client.Post(s.URL, "text/plain", strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("DisableFallback: got status %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+	s, encodings = server("")
+	client = &http.Client{Transport: &compressmw.Transport{FallbackTTL: time.Millisecond}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(s.URL, "text/plain", strings.NewReader(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		time.Sleep(2 * time.Millisecond)
+	}
+	if want := []string{"gzip", "", "gzip", ""}; !slices.Equal(*encodings, want) {
+		t.Errorf("FallbackTTL: server saw %q, want %q", *encodings, want)
+	}
+}
+
+func TestTransportSkips(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var got []string // the Content-Encoding of each request, and whether its body arrived intact
+	const small, large = "<small>", "<this body is more than 16 bytes long>"
+	s := httptest.NewServer(compressmw.ServerAcceptCompressed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		// ServerAcceptCompressed strips the Content-Encoding it decodes, so look at what the client sent.
+		got = append(got, r.Header.Get("X-Sent-Encoding")+" "+fmt.Sprint(err == nil && (string(b) == small || string(b) == large)))
+	})))
+	t.Cleanup(s.Close)
+	sent := roundtripfunc(func(r *http.Request) (*http.Response, error) {
+		r.Header.Set("X-Sent-Encoding", r.Header.Get("Content-Encoding"))
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	tr := &compressmw.Transport{Base: sent, MinSize: 16, ContentTypes: []string{"text/*", "application/json"}}
+	client := &http.Client{Transport: tr}
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	io.WriteString(gw, large)
+	gw.Close()
+
+	for _, tt := range []struct {
+		name, contentType string
+		body              io.Reader
+		ctx               context.Context
+		want              string
+		encoding          string // the Content-Encoding the caller already applied
+	}{
+		{"small", "text/plain", strings.NewReader(small), nil, " true", ""},
+		{"large", "text/plain", strings.NewReader(large), nil, "gzip true", ""},
+		{"small, unknown length", "text/plain", io.MultiReader(strings.NewReader(small)), nil, " true", ""},
+		{"large, unknown length", "text/plain", io.MultiReader(strings.NewReader(large)), nil, "gzip true", ""},
+		{"not allowed", "application/octet-stream", strings.NewReader(large), nil, " true", ""},
+		{"excluded", "image/png", strings.NewReader(large), nil, " true", ""},
+		{"parameters", "application/json; charset=utf-8", strings.NewReader(large), nil, "gzip true", ""},
+		{"opt out", "text/plain", strings.NewReader(large), compressmw.WithRequestEncoding(context.Background(), "identity", 0), " true", ""},
+		{"override", "image/png", strings.NewReader(small), compressmw.WithRequestEncoding(context.Background(), "zstd", 1), "zstd true", ""},
+		{"already encoded", "text/plain", bytes.NewReader(gzipped.Bytes()), nil, "gzip true", "gzip"},
+		{"already encoded, override", "text/plain", bytes.NewReader(gzipped.Bytes()), compressmw.WithRequestEncoding(context.Background(), "zstd", 1), "gzip true", "gzip"},
+	} {
+		ctx := tt.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		got = nil
+		req, err := http.NewRequestWithContext(ctx, "POST", s.URL, tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: got %q, want [%q]", tt.name, got, tt.want)
+		}
+	}
+
+	// a bad override fails the request.
+	req, err := http.NewRequestWithContext(compressmw.WithRequestEncoding(context.Background(), "zstd", 99), "POST", s.URL, strings.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err == nil {
+		t.Error("got no error for an invalid level")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+	// bad configuration is an error, not a panic.
+	for name, err := range map[string]error{
+		"unknown encoding":   func() error { _, err := compressmw.NewCompressor(compressmw.WithEncodings("nope")); return err }(),
+		"bad level":          func() error { _, err := compressmw.NewCompressor(compressmw.WithLevel("gzip", 99)); return err }(),
+		"level not offered":  func() error { _, err := compressmw.NewCompressor(compressmw.WithLevel("zstd", 1)); return err }(),
+		"negative min size":  func() error { _, err := compressmw.NewCompressor(compressmw.WithMinSize(-1)); return err }(),
+		"wrong middleware":   func() error { _, err := compressmw.NewCompressor(compressmw.WithMaxSize(1)); return err }(),
+		"decompressor":       func() error { _, err := compressmw.NewDecompressor(compressmw.WithEncodings("nope")); return err }(),
+		"negative ratio":     func() error { _, err := compressmw.NewDecompressor(compressmw.WithMaxRatio(-1)); return err }(),
+		"transport level":    func() error { _, err := compressmw.NewTransport(compressmw.WithLevel("zstd", 5)); return err }(),
+		"transport encoding": func() error { _, err := compressmw.NewTransport(compressmw.WithLevel("nope", 0)); return err }(),
+		"transport option":   func() error { _, err := compressmw.NewTransport(compressmw.WithEncodings("gzip")); return err }(),
+	} {
+		if err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+
+	// good configuration works.
+	cp, err := compressmw.NewCompressor(compressmw.WithEncodings("zstd", "gzip"), compressmw.WithLevel("zstd", 1), compressmw.WithContentTypes("text/*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := compressmw.NewDecompressor(compressmw.WithMaxSize(1<<20), compressmw.WithRejectTooLarge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := compressmw.NewTransport(compressmw.WithLevel("zstd", 4), compressmw.WithStreaming(), compressmw.WithFallbackTTL(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(cp.Handler(d.Handler(echo)))
+	t.Cleanup(s.Close)
+	const want = "<this is the body>"
+	req, err := http.NewRequest("POST", s.URL, strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := decode(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil || got != want || resp.Header.Get("Content-Encoding") != "zstd" {
+		t.Errorf("got %q, %q, %v, want zstd, %q", resp.Header.Get("Content-Encoding"), got, err, want)
+	}
+}
+
+func TestCompressorFlush(t *testing.T) {
+	t.Parallel()
+	const event = "data: {\"token\": \"hello\"}\n\n"
+	// stream writes an event and flushes it, then waits for the client to read it before finishing the response.
+	stream := func(w http.ResponseWriter, flush func() error, read <-chan struct{}) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, event)
+		if err := flush(); err != nil {
+			t.Errorf("flush: %v", err)
+		}
+		select {
+		case <-read:
+		case <-time.After(5 * time.Second):
+			t.Error("the client never saw the flushed event")
+		}
+	}
+	cp := &compressmw.Compressor{Encodings: []string{"gzip", "zstd", "br"}, MinSize: 1 << 10}
+
+	for _, encoding := range []string{"gzip", "zstd", "br"} {
+		var read chan struct{}
+		router := gin.New()
+		router.Use(cp.Gin())
+		router.GET("/", func(c *gin.Context) {
+			stream(c.Writer, func() error { c.Writer.Flush(); return nil }, read)
+		})
+		handlers := map[string]http.Handler{
+			"net/http": cp.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				stream(w, http.NewResponseController(w).Flush, read)
+			})),
+			"gin": router,
+		}
+		for name, h := range handlers {
+			read = make(chan struct{})
+			s := httptest.NewServer(h)
+			req, err := http.NewRequest("GET", s.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("%s: %s: got Content-Encoding %q", encoding, name, got)
+			}
+			dec, err := decoder(encoding, resp.Body)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", encoding, name, err)
+			}
+			got := make([]byte, len(event))
+			if _, err := io.ReadFull(dec, got); err != nil || string(got) != event {
+				t.Errorf("%s: %s: got %q, %v, want %q", encoding, name, got, err, event)
+			}
+			close(read)
+			resp.Body.Close()
+			s.Close()
+		}
+	}
+}
+
+func TestCompressorAutoFlush(t *testing.T) {
+	t.Parallel()
+	const event = "data: {\"token\": \"hello\"}\n\n"
+	// stream writes an event without flushing it, then waits for the client to read it before finishing the response.
+	stream := func(w http.ResponseWriter, read <-chan struct{}) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range event { // many tiny writes.
+			io.WriteString(w, event[i:i+1])
+		}
+		select {
+		case <-read:
+		case <-time.After(5 * time.Second):
+			t.Error("the client never saw the event")
+		}
+	}
+	for name, cp := range map[string]*compressmw.Compressor{
+		"FlushBytes":    {Encodings: []string{"gzip"}, FlushBytes: len(event)},
+		"FlushInterval": {Encodings: []string{"gzip"}, FlushInterval: 10 * time.Millisecond},
+		"FlushLines":    {Encodings: []string{"gzip"}, FlushLines: compressmw.StreamingContentTypes, MinSize: 1 << 10},
+	} {
+		var read chan struct{}
+		router := gin.New()
+		router.Use(cp.Gin())
+		router.GET("/", func(c *gin.Context) { stream(c.Writer, read) })
+		handlers := map[string]http.Handler{
+			"net/http": cp.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { stream(w, read) })),
+			"gin":      router,
+		}
+		for mw, h := range handlers {
+			read = make(chan struct{})
+			s := httptest.NewServer(h)
+			req, err := http.NewRequest("GET", s.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr, err := decoder("gzip", resp.Body)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", name, mw, err)
+			}
+			got := make([]byte, len(event))
+			if _, err := io.ReadFull(zr, got); err != nil || string(got) != event {
+				t.Errorf("%s: %s: got %q, %v, want %q", name, mw, got, err, event)
+			}
+			close(read)
+			resp.Body.Close()
+			s.Close()
+		}
+	}
+}
+
+func TestCompressorIdleBuffering(t *testing.T) {
+	t.Parallel()
+	// The idle timer fires while MinSize is still buffering: the handler can still set headers, so it doesn't flush until MinSize bytes go out.
+	cp := &compressmw.Compressor{Encodings: []string{"gzip"}, FlushInterval: time.Millisecond, MinSize: 1 << 10}
+	var flushes atomic.Int32
+	h := cp.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<")
+		time.Sleep(20 * time.Millisecond)
+		if n := flushes.Load(); n != 0 {
+			t.Errorf("flushed %d times before MinSize", n)
+		}
+		w.Header().Set("X-Late", "1")
+		io.WriteString(w, strings.Repeat("x", 2<<10))
+		time.Sleep(20 * time.Millisecond)
+		if flushes.Load() == 0 {
+			t.Error("never flushed after MinSize")
+		}
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(flushCounter{w, &flushes}, r)
+	if w.Header().Get("X-Late") != "1" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("got headers %v, want X-Late and gzip", w.Header())
+	}
+	if got, err := decode("gzip", w.Body); err != nil || got != "<"+strings.Repeat("x", 2<<10) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+// flushCounter counts the flushes of a ResponseRecorder.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	n *atomic.Int32
+}
+
+func (f flushCounter) Flush() {
+	f.n.Add(1)
+	f.ResponseRecorder.Flush()
+}
+
+func TestCompressorHijack(t *testing.T) {
+	t.Parallel()
+	const switching = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n"
+	// hijack optionally writes (and flushes) a compressed prefix, then takes over the connection.
+	hijack := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "<compressed>")
+			http.NewResponseController(w).Flush()
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		if r.Header.Get("Upgrade") != "" {
+			brw.WriteString(switching)
+		}
+		brw.WriteString("<raw>")
+		brw.Flush()
+		if _, err := w.Write([]byte("<too late>")); !errors.Is(err, http.ErrHijacked) {
+			t.Errorf("write after hijack: got %v, want %v", err, http.ErrHijacked)
+		}
+	}
+	router := gin.New()
+	router.Use(compressmw.GinGzipBodies(0))
+	router.GET("/", func(c *gin.Context) { hijack(c.Writer, c.Request) })
+	for name, h := range map[string]http.Handler{"net/http": compressmw.ServerGzipResponseBody(http.HandlerFunc(hijack), 0), "gin": router} {
+		s := httptest.NewServer(h)
+		for _, upgrade := range []bool{true, false} {
+			conn, err := net.Dial("tcp", s.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := "GET / HTTP/1.1\r\nHost: test\r\nAccept-Encoding: gzip\r\n"
+			if upgrade {
+				req += "Connection: Upgrade\r\nUpgrade: test\r\n"
+			}
+			io.WriteString(conn, req+"\r\n")
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b, err := io.ReadAll(conn)
+			conn.Close()
+			got := string(b)
+			switch {
+			case err != nil:
+				t.Errorf("%s: upgrade=%v: %v", name, upgrade, err)
+			case upgrade && got != switching+"<raw>":
+				t.Errorf("%s: upgrade: got %q, want %q", name, got, switching+"<raw>")
+			case !upgrade && (!strings.Contains(got, "Content-Encoding: gzip") || !strings.HasSuffix(got, "<raw>")):
+				t.Errorf("%s: hijack after compressing: got %q, want a gzip response followed by <raw>", name, got)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestCompressorRanges(t *testing.T) {
+	t.Parallel()
+	content := strings.Repeat("a range of compressible text. ", 100)
+	modtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.txt", modtime, strings.NewReader(content))
+	})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, content)
+	zw.Close()
+	compressed := gz.Bytes()
+
+	do := func(h http.Handler, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/file.txt", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// RangeIdentity: ranges are of the original content, uncompressed.
+	identity := (&compressmw.Compressor{Encodings: []string{"gzip"}}).Handler(file)
+	w := do(identity, "Range", "bytes=0-9")
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" || w.Body.String() != content[:10] {
+		t.Errorf("identity: got %d, %q, %q, want an uncompressed 206 of %q", w.Code, w.Header().Get("Content-Encoding"), w.Body, content[:10])
+	}
+	if w := do(identity); w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("identity: a plain GET got %q with ETag %q, want gzip with a weak ETag", w.Header().Get("Content-Encoding"), w.Header().Get("ETag"))
+	}
+
+	// RangeCompressed: ranges are of the gzip stream, which is the same every time.
+	router := gin.New()
+	router.Use((&compressmw.Compressor{Encodings: []string{"gzip"}, Ranges: compressmw.RangeCompressed}).Gin())
+	router.GET("/file.txt", func(c *gin.Context) { file(c.Writer, c.Request) })
+	for name, h := range map[string]http.Handler{"net/http": (&compressmw.Compressor{Encodings: []string{"gzip"}, Ranges: compressmw.RangeCompressed}).Handler(file), "gin": router} {
+		w := do(h)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), compressed) || w.Header().Get("ETag") != `"v1-gzip"` {
+			t.Fatalf("%s: plain GET: got %d with ETag %q, want the whole gzip stream with ETag %q", name, w.Code, w.Header().Get("ETag"), `"v1-gzip"`)
+		}
+		w = do(h, "Range", "bytes=10-19")
+		wantRange := fmt.Sprintf("bytes 10-19/%d", len(compressed))
+		if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Range") != wantRange ||
+			w.Header().Get("Content-Length") != "10" || !bytes.Equal(w.Body.Bytes(), compressed[10:20]) {
+			t.Errorf("%s: range: got %d, %v, want 206 of %s", name, w.Code, w.Header(), wantRange)
+		}
+		if w := do(h, "Range", "bytes=10-19", "If-Range", `"v1-gzip"`); w.Code != http.StatusPartialContent {
+			t.Errorf("%s: matching If-Range: got %d, want 206", name, w.Code)
+		}
+		if w := do(h, "Range", "bytes=10-19", "If-Range", `"v0-gzip"`); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), compressed) {
+			t.Errorf("%s: stale If-Range: got %d, want the whole 200", name, w.Code)
+		}
+		for _, rng := range []string{fmt.Sprintf("bytes=%d-", len(compressed)), "bytes=9999999-"} {
+			w := do(h, "Range", rng)
+			if w.Code != http.StatusRequestedRangeNotSatisfiable {
+				t.Errorf("%s: %s: got %d, want 416", name, rng, w.Code)
+			}
+			// ServeContent's error is plain text: it mustn't claim to be gzip.
+			if ce, etag := w.Header().Get("Content-Encoding"), w.Header().Get("ETag"); ce != "" || etag != "" || !strings.Contains(w.Body.String(), "range") {
+				t.Errorf("%s: %s: got Content-Encoding %q, ETag %q, body %q, want a plain-text error", name, rng, ce, etag, w.Body)
+			}
+		}
+		if w := do(h, "If-None-Match", `"v1-gzip"`); w.Code != http.StatusNotModified || w.Header().Get("ETag") != `"v1-gzip"` {
+			t.Errorf("%s: revalidating: got %d with ETag %q, want 304 with %q", name, w.Code, w.Header().Get("ETag"), `"v1-gzip"`)
+		}
+	}
+
+	// a partial response from the handler is never compressed, whatever the policy.
+	partial := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-9/100")
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, content[:10])
+	})
+	for _, ranges := range []compressmw.RangePolicy{compressmw.RangeIdentity, compressmw.RangeCompressed} {
+		w := do((&compressmw.Compressor{Encodings: []string{"gzip"}, Ranges: ranges}).Handler(partial))
+		if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" || w.Body.String() != content[:10] {
+			t.Errorf("ranges=%d: handler's 206: got %d, %q, %q", ranges, w.Code, w.Header().Get("Content-Encoding"), w.Body)
+		}
+	}
+	if _, err := compressmw.NewCompressor(compressmw.WithRanges(7)); err == nil {
+		t.Error("NewCompressor: got no error for an unknown RangePolicy")
+	}
+}
+
+func TestFileServer(t *testing.T) {
+	t.Parallel()
+	compress := func(encoding, s string) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		}
+		io.WriteString(w, s)
+		w.Close()
+		return buf.Bytes()
+	}
+	const js, schema, page = "console.log('hello, world');\n", `{"type": "object"}`, "<!doctype html><title>dashboard</title>"
+	fsys := fstest.MapFS{
+		"app.js":              {Data: []byte(js)},
+		"app.js.br":           {Data: compress("br", js)},
+		"app.js.gz":           {Data: compress("gzip", js)},
+		"schema.json":         {Data: []byte(schema)},
+		"dash/index.html":     {Data: []byte(page)},
+		"dash/index.html.gz":  {Data: compress("gzip", page)},
+		"noext":               {Data: []byte(page)},
+		"noext.gz":            {Data: compress("gzip", page)},
+		"dash/unrelated.html": {Data: []byte(page)},
+		"lone.js.gz":          {Data: compress("gzip", js)}, // a variant of nothing.
+	}
+	s := httptest.NewServer((&compressmw.FileServer{FS: fsys, Compressor: &compressmw.Compressor{Encodings: []string{"zstd"}}}).Handler())
+	t.Cleanup(s.Close)
+
+	get := func(path, accept string, header ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", accept)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req) // not http.Get: it would ask for, and decode, gzip itself.
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, tt := range []struct {
+		path, accept    string
+		encoding, ctype string
+		want            string
+		wantLength      int
+	}{
+		{"/app.js", "gzip, br", "br", "text/javascript; charset=utf-8", js, len(fsys["app.js.br"].Data)},
+		{"/app.js", "gzip, br;q=0.5", "gzip", "text/javascript; charset=utf-8", js, len(fsys["app.js.gz"].Data)},
+		{"/app.js", "identity", "", "text/javascript; charset=utf-8", js, len(js)},
+		{"/app.js", "zstd", "zstd", "text/javascript; charset=utf-8", js, -1}, // no variant: compressed on the fly, so we don't know its length.
+		{"/schema.json", "gzip", "", "application/json", schema, len(schema)},
+		{"/dash/", "gzip", "gzip", "text/html; charset=utf-8", page, len(fsys["dash/index.html.gz"].Data)},
+		{"/noext", "gzip", "gzip", "text/html; charset=utf-8", page, len(fsys["noext.gz"].Data)},
+	} {
+		resp := get(tt.path, tt.accept)
+		got, err := decode(resp.Header.Get("Content-Encoding"), resp.Body)
+		if err != nil || got != tt.want || resp.StatusCode != http.StatusOK {
+			t.Errorf("%s, %q: got %d, %q, %v, want %q", tt.path, tt.accept, resp.StatusCode, got, err, tt.want)
+		}
+		if ce, ct := resp.Header.Get("Content-Encoding"), resp.Header.Get("Content-Type"); ce != tt.encoding || ct != tt.ctype {
+			t.Errorf("%s, %q: got Content-Encoding %q, Content-Type %q, want %q, %q", tt.path, tt.accept, ce, ct, tt.encoding, tt.ctype)
+		}
+		if tt.wantLength >= 0 && resp.ContentLength != int64(tt.wantLength) {
+			t.Errorf("%s, %q: got Content-Length %d, want %d", tt.path, tt.accept, resp.ContentLength, tt.wantLength)
+		}
+		if !slices.Contains(resp.Header.Values("Vary"), "Accept-Encoding") {
+			t.Errorf("%s, %q: got Vary %q", tt.path, tt.accept, resp.Header.Values("Vary"))
+		}
+	}
+
+	// each variant has its own ETag, which conditional requests honor.
+	br, gz := get("/app.js", "br"), get("/app.js", "gzip")
+	etag := br.Header.Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") || etag == gz.Header.Get("ETag") {
+		t.Errorf("got ETags %q (br) and %q (gzip): want distinct strong ETags", etag, gz.Header.Get("ETag"))
+	}
+	if resp := get("/app.js", "br", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Errorf("If-None-Match: got status %d, ETag %q, want %d, %q", resp.StatusCode, resp.Header.Get("ETag"), http.StatusNotModified, etag)
+	}
+
+	// ranges are over the variant's bytes.
+	variant := fsys["app.js.br"].Data
+	resp := get("/app.js", "br", "Range", "bytes=2-5", "If-Range", etag)
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(b, variant[2:6]) || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes 2-5/%d", len(variant)) {
+		t.Errorf("Range: got status %d, Content-Range %q, body %q, want 206 and %q", resp.StatusCode, resp.Header.Get("Content-Range"), b, variant[2:6])
+	}
+	if resp := get("/app.js", "br", "Range", "bytes=2-5", "If-Range", gz.Header.Get("ETag")); resp.StatusCode != http.StatusOK {
+		t.Errorf("If-Range with another variant's ETag: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	// ServeContent's errors are plain text, not the variant.
+	resp = get("/app.js", "br", "Range", "bytes=100000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("ETag") != "" {
+		t.Errorf("unsatisfiable Range: got status %d, Content-Encoding %q, ETag %q, want 416 without either",
+			resp.StatusCode, resp.Header.Get("Content-Encoding"), resp.Header.Get("ETag"))
+	}
+
+	// a variant without its original isn't served.
+	if resp := get("/lone.js", "gzip"); resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("lone variant: got status %d, Content-Encoding %q, want 404", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+
+	// without a Compressor, files without a variant are gzipped on the fly; a Compressor without Encodings leaves them alone.
+	for _, tt := range []struct {
+		cp       *compressmw.Compressor
+		encoding string
+	}{{nil, "gzip"}, {&compressmw.Compressor{}, ""}} {
+		r := httptest.NewRequest("GET", "/schema.json", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		(&compressmw.FileServer{FS: fsys, Compressor: tt.cp}).Handler().ServeHTTP(w, r)
+		got, err := decode(w.Header().Get("Content-Encoding"), w.Body)
+		if ce := w.Header().Get("Content-Encoding"); ce != tt.encoding || err != nil || got != schema {
+			t.Errorf("Compressor %+v: got Content-Encoding %q, %q, %v, want %q, %q", tt.cp, ce, got, err, tt.encoding, schema)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// contenttype.go decides which response Content-Types are worth compressing.
+package compressmw
+
+import (
+	"mime"
+	"strings"
+)
+
+// DefaultExcludedContentTypes are the media types a Compressor skips when its ExcludedContentTypes is nil:
+// formats that are already compressed, where another pass just burns CPU.
+var DefaultExcludedContentTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif", "image/heic",
+	"video/*", "audio/*",
+	"font/woff", "font/woff2",
+	"application/gzip", "application/x-gzip", "application/zstd", "application/x-brotli",
+	"application/zip", "application/x-bzip2", "application/x-xz", "application/x-7z-compressed", "application/vnd.rar",
+}
+
+// mediaTypes matches Content-Types against lists of patterns: exact ("application/json"), "type/*", or "*/*".
+type mediaTypes struct {
+	allow []string // empty allows everything not denied
+	deny  []string
+}
+
+func newMediaTypes(allow, deny []string) mediaTypes {
+	if deny == nil {
+		deny = DefaultExcludedContentTypes
+	}
+	return mediaTypes{allow: lowerAll(allow), deny: lowerAll(deny)}
+}
+
+func lowerAll(patterns []string) []string {
+	lower := make([]string, len(patterns))
+	for i := range patterns {
+		lower[i] = strings.ToLower(strings.TrimSpace(patterns[i]))
+	}
+	return lower
+}
+
+// match reports whether contentType (a Content-Type header, parameters and all) is allowed and not denied.
+// An empty or unparseable Content-Type only matches if there's no allow list.
+func (m mediaTypes) match(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return len(m.allow) == 0
+	}
+	if matchMediaType(m.deny, mediaType) {
+		return false
+	}
+	return len(m.allow) == 0 || matchMediaType(m.allow, mediaType)
+}
+
+// matchMediaType reports whether the (lowercase, parameterless) mediaType matches any of patterns.
+func matchMediaType(patterns []string, mediaType string) bool {
+	for _, p := range patterns {
+		switch {
+		case p == "*/*", p == mediaType:
+			return true
+		case strings.HasSuffix(p, "/*") && strings.HasPrefix(mediaType, p[:len(p)-1]):
+			return true
+		}
+	}
+	return false
+}
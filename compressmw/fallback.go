@@ -0,0 +1,121 @@
+// fallback.go handles servers that refuse compressed request bodies.
+//
+// A server that can't decode a request's Content-Encoding should respond 415 Unsupported Media Type,
+// listing the codings it does accept, if any, in an Accept-Encoding header (RFC 7694).
+// A Transport retries such requests once, with the best of those codings or uncompressed,
+// and remembers what worked for the host, so later requests don't pay for the 415 again.
+package compressmw
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultFallbackTTL is how long a Transport remembers a host's content-coding when its FallbackTTL is 0.
+const defaultFallbackTTL = 10 * time.Minute
+
+// maxHosts is how many hosts a hostCache holds. Once it's full, adding a host prunes expired entries, or else evicts the one expiring soonest.
+const maxHosts = 1024
+
+// hostCache remembers the content-coding to compress request bodies with, per host. The zero value is ready to use.
+type hostCache struct {
+	mu    sync.Mutex
+	hosts map[string]hostEntry
+}
+
+type hostEntry struct {
+	o       offer // the zero offer means identity: don't compress.
+	expires time.Time
+}
+
+// get returns the offer learned for host, if it hasn't expired.
+func (hc *hostCache) get(host string) (offer, bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	e, ok := hc.hosts[host]
+	if !ok {
+		return offer{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(hc.hosts, host)
+		return offer{}, false
+	}
+	return e.o, true
+}
+
+// set remembers o for host for ttl.
+func (hc *hostCache) set(host string, o offer, ttl time.Duration) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.hosts == nil {
+		hc.hosts = make(map[string]hostEntry)
+	}
+	now := time.Now()
+	if _, ok := hc.hosts[host]; !ok && len(hc.hosts) >= maxHosts {
+		var soonest string
+		for h, e := range hc.hosts {
+			if now.After(e.expires) {
+				delete(hc.hosts, h)
+			} else if soonest == "" || e.expires.Before(hc.hosts[soonest].expires) {
+				soonest = h
+			}
+		}
+		if len(hc.hosts) >= maxHosts {
+			delete(hc.hosts, soonest)
+		}
+	}
+	hc.hosts[host] = hostEntry{o: o, expires: now.Add(ttl)}
+}
+
+// fallbackEncodings are the codings a Transport falls back to, in our order of preference.
+var fallbackEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+// fallbackOffer picks what to retry with after a 415 to a request compressed with o, given the response's Accept-Encoding headers:
+// the best of o and the built-in codings (at their default levels) that the server accepts, or the zero offer for identity.
+// No Accept-Encoding at all means identity, as it does for negotiate: the server told us nothing, so send what every server understands.
+func fallbackOffer(headers []string, o offer) offer {
+	offers := []offer{o}
+	for _, name := range fallbackEncodings {
+		if c := lookup(name); c != o.c {
+			offers = append(offers, offer{c: c, lvl: c.def})
+		}
+	}
+	if i := negotiate(headers, offers); i >= 0 {
+		return offers[i]
+	}
+	return offer{}
+}
+
+// fallback retries r, which the server answered with resp, a 415, after we compressed its body with o.
+// If the server says it accepts o after all, the 415 is about something else (the Content-Type, say), and we return resp as-is.
+// Otherwise we resend the body from rp with the fallback coding, and remember that coding for the host if the server takes it.
+func (t *Transport) fallback(r *http.Request, o offer, resp *http.Response, rp *replay) (*http.Response, error) {
+	next := fallbackOffer(resp.Header.Values("Accept-Encoding"), o)
+	if next.c == o.c {
+		return resp, nil
+	}
+	body, err := rp.get()
+	if err != nil {
+		return resp, nil // we can't resend the body: the 415 is the best answer we have.
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10)) // drain a little, so the connection can be reused.
+	resp.Body.Close()
+
+	r2 := r.Clone(r.Context())
+	r2.Body, r2.ContentLength, r2.GetBody = body, rp.size, rp.get
+	if next.c == nil {
+		resp, err = t.base().RoundTrip(r2)
+	} else {
+		resp, _, err = t.send(r2, next)
+	}
+	if err == nil && resp.StatusCode != http.StatusUnsupportedMediaType {
+		ttl := t.FallbackTTL
+		if ttl <= 0 {
+			ttl = defaultFallbackTTL
+		}
+		t.hosts.set(r.URL.Host, next, ttl)
+	}
+	return resp, err
+}
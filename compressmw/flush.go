@@ -0,0 +1,57 @@
+// flush.go flushes compressed streaming responses on the handler's behalf: every N bytes, after an idle period, or on newlines.
+// A compressor holds back output until it has enough to compress well, so without a flush, a slow stream reaches the client in bursts.
+package compressmw
+
+import (
+	"bytes"
+	"time"
+)
+
+// StreamingContentTypes are the line-delimited streaming media types: server-sent events and NDJSON / JSON Lines.
+// Use them as a Compressor's FlushLines.
+var StreamingContentTypes = []string{"text/event-stream", "application/x-ndjson", "application/ndjson", "application/jsonl"}
+
+// flushLines matches the media types in patterns, or returns nil if there are none.
+func flushLines(patterns []string) *mediaTypes {
+	if len(patterns) == 0 {
+		return nil
+	}
+	m := newMediaTypes(patterns, []string{})
+	return &m
+}
+
+// autoflush flushes after the handler writes b, if the policy says to, or (re)starts the idle timer. cw.mu must be held.
+func (cw *compressWriter) autoflush(b []byte) error {
+	p := cw.p
+	if p.flushBytes == 0 && p.flushInterval == 0 && p.flushLines == nil {
+		return nil
+	}
+	cw.unflushed += len(b)
+	switch {
+	case cw.unflushed == 0:
+		return nil
+	case p.flushBytes > 0 && cw.unflushed >= p.flushBytes,
+		p.flushLines != nil && bytes.IndexByte(b, '\n') >= 0 && p.flushLines.match(cw.Header().Get("Content-Type")):
+		if cw.timer != nil {
+			cw.timer.Stop()
+		}
+		return cw.flush()
+	case p.flushInterval > 0 && cw.timer == nil:
+		cw.timer = time.AfterFunc(p.flushInterval, cw.idle)
+	case p.flushInterval > 0:
+		cw.timer.Reset(p.flushInterval)
+	}
+	return nil
+}
+
+// idle flushes whatever the handler's written since the last flush, unless it's already returned.
+// It runs on the timer's goroutine, so it only flushes once we've decided and written the header:
+// until then (while MinSize buffers the response), the handler may still be setting headers, and deciding reads and changes them.
+func (cw *compressWriter) idle() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.closed || !cw.decided || cw.unflushed == 0 {
+		return
+	}
+	cw.flush()
+}
@@ -4,142 +4,190 @@ package compressmw
 
 import (
 	"bufio"
-	"io"
 	"net"
 	"net/http"
 
-	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
 )
 
-func GinAcceptGzip(c *gin.Context) {
-	i := hasGzipAt(c.Request.Header.Values("Content-Encoding"))
-	if i == -1 {
-		c.Next() // we didn't find a gzip encoding, so we can skip the rest of this middleware.
-		return
+// Gin is the gin equivalent of Handler: it decompresses request bodies. It panics if an encoding isn't registered.
+// Requests that can't be decoded are aborted after the ErrorHandler runs, with the *DecodeError or *UnsupportedEncodingError recorded in c.Errors.
+func (d *Decompressor) Gin() gin.HandlerFunc {
+	p := d.mustPolicy()
+	return func(c *gin.Context) {
+		body, done, err := p.decodeRequest(c.Request)
+		if err != nil {
+			p.fail(c.Writer, c.Request, err)
+			c.Error(err)
+			c.Abort()
+			return
+		}
+		defer done()
+		if body != nil && p.reject {
+			g := &ginCompatRejectWriter{ResponseWriter: c.Writer}
+			body.onLimit = g.reject
+			c.Writer = g
+		}
+		c.Next()
 	}
-	// remove the gzip encoding from the header.
-	c.Request.Header["Content-Encoding"] = append(c.Request.Header["Content-Encoding"][:i], c.Request.Header["Content-Encoding"][i+1:]...)
-	defer c.Request.Body.Close()
-
-	// replace the request body with a streaming, decompressing reader.
-	zipreader := getzipreader(c.Request.Body)
-	defer putzipreader(zipreader)
-	c.Request.Body = zipreader
-	c.Next()
 }
 
-// GinGzipOrBrotliBodies is a gin.HandlerFunc that sniffs the client's Accept-Encoding header for 'br', 'gzip', or 'x-gzip',
-// and compresses the response body with brotli or gzip, respectively, setting the response's Content-Encoding header accordingly.
-func GinGzipOrBrotliBodies(c *gin.Context) {
-	wc := brotli.HTTPCompressor(c.Writer, c.Request)
-	defer wc.Close()
-	c.Writer = &ginCompatGzipOrBrotliWriter{ginResponseWriter: c.Writer, compressWriter: wc}
-	c.Next()
+// GinAcceptCompressed is the gin equivalent of ServerAcceptCompressed: it transparently decompresses request bodies whose Content-Encoding is one of encodings,
+// leaving other registered codings applied after them for other middleware: see Decompressor.Encodings for when it responds 415 instead.
+// With no encodings, it decodes any registered Codec, and rejects unregistered codings with a 415.
+// It panics if an encoding isn't registered.
+func GinAcceptCompressed(encodings ...string) gin.HandlerFunc {
+	return (&Decompressor{Encodings: encodings, RejectUnsupported: len(encodings) == 0}).Gin()
 }
 
-// GinGzipBodies is a gin.HandlerFunc that compresses the response body with gzip if the client accepts it. Level is in the range 1(gzip.BestSpeed) to 9(gzip.BestCompression). 0 or -1 default to 6.
-func GinGzipBodies(lvl int) gin.HandlerFunc {
-	lvl = checkgziplevel(lvl)
+// Gin is the gin equivalent of Handler: it compresses response bodies with the best of cp.Encodings the client accepts.
+// It panics if an encoding isn't registered or a level is out of range.
+func (cp *Compressor) Gin() gin.HandlerFunc {
+	p := cp.mustPolicy()
 	return func(c *gin.Context) {
-		i := hasGzipAt(c.Request.Header.Values("Accept-Encoding"))
-		if i == -1 {
-			// we didn't find a gzip encoding, so we can skip the rest of this middleware.
-			c.Next()
-			return
-		}
-
-		// remove 'accept-encoding: gzip' from the header: we don't want something later down the line to do it again.
-		c.Request.Header["Accept-Encoding"] = append(c.Request.Header["Accept-Encoding"][:i], c.Request.Header["Accept-Encoding"][i+1:]...)
-		// set the response header to indicate we're sending gzip.
-		// then replace the response writer with a streaming, compressing writer.
-		c.Writer.Header().Set("Content-Encoding", "gzip")
-		zipwriter := getzipwriter(c.Writer, lvl)
-		defer putzipwriter(zipwriter, lvl)
-		c.Writer = &ginCompatGzipWriter{c.Writer, gzipWriter{rw: c.Writer, gzipw: zipwriter}}
+		// replace the response writer with a streaming, compressing writer.
+		// even if we're not compressing, it fixes up the headers.
+		g := &ginCompatCompressWriter{c.Writer, compressWriter{rw: c.Writer, p: p}}
+		g.cw.start(c.Request)
+		defer g.cw.close()
+		c.Writer = g
 		c.Next()
 	}
 }
 
-type ginCompatGzipOrBrotliWriter struct {
-	ginResponseWriter gin.ResponseWriter
-	compressWriter    io.WriteCloser
-	status            int
+// GinCompressBodies is the gin equivalent of ServerCompressResponseBody: it compresses the response body with the registered Codec named by encoding if the client accepts it.
+// Level is checked against the Codec's Levels: 0 or -1 select its default. It panics if encoding isn't registered or the level is out of range.
+func GinCompressBodies(encoding string, lvl int) gin.HandlerFunc {
+	return (&Compressor{Encodings: []string{encoding}, Levels: map[string]int{encoding: lvl}}).Gin()
+}
+
+// GinCompressor is a configurable gin middleware compressing response bodies: it offers br, zstd and gzip, in that order, at their default levels,
+// unless opts say otherwise (see NewCompressor). The consumed Accept-Encoding is removed from the request, and the Encoders are pooled per level.
+// It panics if opts are invalid.
+//
+//	router.Use(compressmw.GinCompressor(compressmw.WithLevel("br", 4), compressmw.WithLevel("gzip", 9), compressmw.WithPreferOrder()))
+func GinCompressor(opts ...Option) gin.HandlerFunc {
+	cp, err := NewCompressor(append([]Option{WithEncodings(defaultAcceptEncodings...)}, opts...)...)
+	if err != nil {
+		panic(err)
+	}
+	return cp.Gin()
 }
 
-var _ gin.ResponseWriter = (*ginCompatGzipOrBrotliWriter)(nil)
+var (
+	ginAcceptGzip         = GinAcceptCompressed("gzip")
+	ginAcceptZstd         = GinAcceptCompressed("zstd")
+	ginAcceptDeflate      = GinAcceptCompressed("deflate")
+	ginGzipOrBrotliBodies = (&Compressor{Encodings: []string{"br", "gzip"}}).Gin()
+)
+
+// GinAcceptGzip transparently decompresses request bodies with a Content-Encoding of "gzip" or "x-gzip".
+// Like ServerAcceptGzip, it responds 415 to "gzip, br" or an unregistered coding.
+func GinAcceptGzip(c *gin.Context) { ginAcceptGzip(c) }
+
+// GinAcceptZstd is the gin equivalent of ServerAcceptZstd: it transparently decompresses request bodies with a Content-Encoding of "zstd".
+func GinAcceptZstd(c *gin.Context) { ginAcceptZstd(c) }
+
+// GinAcceptDeflate is the gin equivalent of ServerAcceptDeflate: it transparently decompresses request bodies with a Content-Encoding of "deflate", zlib-wrapped or raw.
+func GinAcceptDeflate(c *gin.Context) { ginAcceptDeflate(c) }
+
+// GinGzipOrBrotliBodies is a gin.HandlerFunc that negotiates 'br', 'gzip', or 'x-gzip' from the client's Accept-Encoding header,
+// and compresses the response body with brotli or gzip, respectively, setting the response's Content-Encoding header accordingly.
+// Brotli wins ties. Both use their default levels: see GinCompressor to choose the levels, the encodings, and their order.
+func GinGzipOrBrotliBodies(c *gin.Context) { ginGzipOrBrotliBodies(c) }
+
+// GinGzipBodies is a gin.HandlerFunc that compresses the response body with gzip if the client accepts it. Level is in the range 1(gzip.BestSpeed) to 9(gzip.BestCompression). 0 or -1 default to 6.
+func GinGzipBodies(lvl int) gin.HandlerFunc { return GinCompressBodies("gzip", lvl) }
+
+// GinBrotliBodies is a gin.HandlerFunc that compresses the response body with brotli if the client accepts it. Quality is in the range 1 to 11(brotli.BestCompression). 0 or -1 default to 6.
+func GinBrotliBodies(quality int) gin.HandlerFunc { return GinCompressBodies("br", quality) }
+
+// GinDeflateBodies is a gin.HandlerFunc that compresses the response body with deflate (zlib-wrapped) if the client accepts it. Level is in the range 1(flate.BestSpeed) to 9(flate.BestCompression). 0 or -1 default to 6.
+func GinDeflateBodies(lvl int) gin.HandlerFunc { return GinCompressBodies("deflate", lvl) }
 
-func (g *ginCompatGzipOrBrotliWriter) Flush()              { g.ginResponseWriter.Flush() }
-func (g *ginCompatGzipOrBrotliWriter) Pusher() http.Pusher { return g.ginResponseWriter.Pusher() }
-func (g *ginCompatGzipOrBrotliWriter) Header() http.Header { return g.ginResponseWriter.Header() }
-func (g *ginCompatGzipOrBrotliWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return g.ginResponseWriter.Hijack()
+// GinZstdBodies is a gin.HandlerFunc that compresses the response body with zstd if the client accepts it. Level is in the range 1(zstd.SpeedFastest) to 4(zstd.SpeedBestCompression). 0 or -1 default to 2.
+func GinZstdBodies(lvl int) gin.HandlerFunc { return GinCompressBodies("zstd", lvl) }
+
+// ginCompatCompressWriter implements all 10 billion methods of gin.ResponseWriter
+// in order to write a simple middleware.
+// I _strongly_ dislike gin, but it's what we already use...
+type ginCompatCompressWriter struct {
+	ginResponseWriter gin.ResponseWriter
+	cw                compressWriter
 }
 
-func (g *ginCompatGzipOrBrotliWriter) Status() int {
-	if g.status != 0 {
-		return g.status
+var _ gin.ResponseWriter = (*ginCompatCompressWriter)(nil)
+
+func (g *ginCompatCompressWriter) Flush()              { g.cw.FlushError() }
+func (g *ginCompatCompressWriter) Pusher() http.Pusher { return g.ginResponseWriter.Pusher() }
+func (g *ginCompatCompressWriter) Header() http.Header { return g.ginResponseWriter.Header() }
+func (g *ginCompatCompressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return g.cw.Hijack()
+}
+func (g *ginCompatCompressWriter) WriteString(s string) (int, error) { return g.Write([]byte(s)) }
+func (g *ginCompatCompressWriter) Status() int {
+	if g.cw.status != 0 {
+		return g.cw.status
 	}
 	return g.ginResponseWriter.Status()
 }
-func (g *ginCompatGzipOrBrotliWriter) WriteString(s string) (int, error) { return g.Write([]byte(s)) }
-func (g *ginCompatGzipOrBrotliWriter) Written() bool                     { return g.ginResponseWriter.Written() }
-func (g *ginCompatGzipOrBrotliWriter) Size() int                         { return g.ginResponseWriter.Size() }
-func (g *ginCompatGzipOrBrotliWriter) CloseNotify() <-chan bool {
-	return g.ginResponseWriter.CloseNotify()
-}
 
-func (g *ginCompatGzipOrBrotliWriter) WriteHeader(code int) {
-	g.status = code
-	g.ginResponseWriter.WriteHeader(code)
+func (g *ginCompatCompressWriter) Written() bool { return g.ginResponseWriter.Written() }
+func (g *ginCompatCompressWriter) Write(data []byte) (int, error) {
+	g.cw.WriteHeader(http.StatusOK)
+	return g.cw.Write(data)
 }
 
-func (g *ginCompatGzipOrBrotliWriter) WriteHeaderNow() {
-	if g.status == 0 {
-		g.status = http.StatusOK
-	}
-	g.ginResponseWriter.WriteHeader(g.status)
-}
+func (g *ginCompatCompressWriter) Size() int            { return g.ginResponseWriter.Size() }
+func (g *ginCompatCompressWriter) WriteHeader(code int) { g.cw.WriteHeader(code) }
 
-func (g *ginCompatGzipOrBrotliWriter) Write(data []byte) (int, error) {
-	if g.status == 0 {
-		g.status = http.StatusOK
+// WriteHeaderNow forces compressWriter to decide without knowing the body's size, so it only compresses if there's no minSize.
+func (g *ginCompatCompressWriter) WriteHeaderNow() {
+	g.cw.mu.Lock()
+	defer g.cw.mu.Unlock()
+	g.cw.decide(!g.cw.buffering(), nil)
+	if !g.cw.capturing() { // the status goes out with the range we serve.
+		g.ginResponseWriter.WriteHeaderNow()
 	}
-	return g.compressWriter.Write(data)
 }
+func (g *ginCompatCompressWriter) CloseNotify() <-chan bool { return g.ginResponseWriter.CloseNotify() }
 
-// ginCompatGzipWriter implements all 10 billion methods of gin.ResponseWriter
-// in order to write a simple middleware.
-// I _strongly_ dislike gin, but it's what we already use...
-type ginCompatGzipWriter struct {
-	ginResponseWriter gin.ResponseWriter
-	gzipw             gzipWriter
+// ginCompatRejectWriter is rejectWriter for gin. Embedding gin.ResponseWriter gets us the other 10 billion methods for free.
+type ginCompatRejectWriter struct {
+	gin.ResponseWriter
+	err error // non-nil once we've rejected the request
 }
 
-var _ gin.ResponseWriter = (*ginCompatGzipWriter)(nil)
+var _ gin.ResponseWriter = (*ginCompatRejectWriter)(nil)
 
-func (g *ginCompatGzipWriter) Flush()              { g.ginResponseWriter.Flush() }
-func (g *ginCompatGzipWriter) Pusher() http.Pusher { return g.ginResponseWriter.Pusher() }
-func (g *ginCompatGzipWriter) Header() http.Header { return g.ginResponseWriter.Header() }
-func (g *ginCompatGzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return g.ginResponseWriter.Hijack()
+func (g *ginCompatRejectWriter) WriteHeader(code int) {
+	if g.err == nil {
+		g.ResponseWriter.WriteHeader(code)
+	}
 }
-func (g *ginCompatGzipWriter) WriteString(s string) (int, error) { return g.Write([]byte(s)) }
-func (g *ginCompatGzipWriter) Status() int {
-	if g.gzipw.status != 0 {
-		return g.gzipw.status
+
+func (g *ginCompatRejectWriter) WriteHeaderNow() {
+	if g.err == nil {
+		g.ResponseWriter.WriteHeaderNow()
 	}
-	return g.ginResponseWriter.Status()
 }
 
-func (g *ginCompatGzipWriter) Written() bool { return g.ginResponseWriter.Written() }
-func (g *ginCompatGzipWriter) Write(data []byte) (int, error) {
-	g.gzipw.WriteHeader(http.StatusOK)
-	return g.gzipw.Write(data)
+func (g *ginCompatRejectWriter) Write(b []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.ResponseWriter.Write(b)
 }
 
-func (g *ginCompatGzipWriter) Size() int            { return g.ginResponseWriter.Size() }
-func (g *ginCompatGzipWriter) WriteHeader(code int) { g.gzipw.WriteHeader(code) }
+func (g *ginCompatRejectWriter) WriteString(s string) (int, error) { return g.Write([]byte(s)) }
 
-func (g *ginCompatGzipWriter) WriteHeaderNow()          { g.ginResponseWriter.WriteHeaderNow() }
-func (g *ginCompatGzipWriter) CloseNotify() <-chan bool { return g.ginResponseWriter.CloseNotify() }
+// reject responds 413, if it's not too late.
+func (g *ginCompatRejectWriter) reject(err error) {
+	if g.Written() {
+		return
+	}
+	g.Header().Set("Connection", "close") // there's no point reading the rest of the body.
+	g.ResponseWriter.WriteHeader(http.StatusRequestEntityTooLarge)
+	g.ResponseWriter.WriteString(http.StatusText(http.StatusRequestEntityTooLarge))
+	g.err = err
+}
@@ -0,0 +1,129 @@
+// limit.go defines the errors for request bodies that can't be decompressed safely:
+// decompression bombs (small bodies that expand to gigabytes) and malformed streams.
+package compressmw
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ratioGrace is how much a body may decompress to before MaxRatio is enforced, so small, highly-repetitive bodies aren't rejected.
+const ratioGrace = 1 << 20
+
+// A TooLargeError is returned from a decompressed request body's Read once it exceeds a Decompressor's MaxSize or MaxRatio.
+type TooLargeError struct {
+	Encoding     string  // the content-coding being decoded, e.g, "gzip"
+	MaxSize      int64   // the Decompressor's MaxSize
+	MaxRatio     float64 // the Decompressor's MaxRatio
+	Decompressed int64   // decompressed bytes read so far
+	Compressed   int64   // compressed bytes read so far. decoders read ahead, so this is approximate.
+}
+
+func (e *TooLargeError) Error() string {
+	if e.MaxSize > 0 && e.Decompressed > e.MaxSize {
+		return fmt.Sprintf("compressmw: %s request body decompresses to more than %d bytes", e.Encoding, e.MaxSize)
+	}
+	return fmt.Sprintf("compressmw: %s request body exceeds a compression ratio of %g: %d bytes from %d", e.Encoding, e.MaxRatio, e.Decompressed, e.Compressed)
+}
+
+// A DecodeError describes a request body that couldn't be decoded: for example, "Content-Encoding: gzip" with a corrupt gzip header.
+// A Decompressor passes it to its ErrorHandler.
+type DecodeError struct {
+	Encoding string // the content-coding we tried to decode, e.g, "gzip", or all of them, e.g, "gzip, br", if we can't tell which layer failed
+	Err      error  // the Decoder's error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("compressmw: malformed %s request body: %v", e.Encoding, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// An UnsupportedEncodingError describes a request body with a content-coding a Decompressor doesn't decode, and won't leave for other middleware:
+// for example, "Content-Encoding: compress" to ServerAcceptCompressed, or "gzip, br" to ServerAcceptGzip.
+// A Decompressor passes it to its ErrorHandler, after listing Accepted in the response's Accept-Encoding header.
+type UnsupportedEncodingError struct {
+	Encoding string   // the first coding, in the order they're removed, that we can't decode
+	Accepted []string // the codings the Decompressor does decode
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("compressmw: unsupported request Content-Encoding %q: accepted encodings are %s", e.Encoding, strings.Join(e.Accepted, ", "))
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitReader reads a decompressed body, failing with a *TooLargeError once it exceeds maxSize or maxRatio.
+// Like http.MaxBytesReader, the error sticks, and it's reported to onLimit, if set.
+type limitReader struct {
+	dec        io.Reader    // decompressed body
+	compressed *countReader // the compressed body dec reads from
+	encoding   string
+	maxSize    int64   // 0 for no limit
+	maxRatio   float64 // 0 for no limit
+	n          int64   // decompressed bytes read so far
+	err        error   // sticky *TooLargeError
+	onLimit    func(error)
+
+	head    [512]byte // the start of the decompressed body, read by prime
+	headN   int       // bytes in head
+	headOff int       // bytes of head already read
+	headErr error     // the error, if any, that ended prime's read
+}
+
+// prime reads the start of the body, so streams that are malformed from the outset are caught before the handler sees them.
+// It returns any error but io.EOF: an empty body is fine.
+func (l *limitReader) prime() error {
+	l.headN, l.headErr = io.ReadAtLeast(l.dec, l.head[:], 1)
+	if l.headErr == io.EOF {
+		return nil
+	}
+	return l.headErr
+}
+
+// read reads what prime read, then the rest of dec.
+func (l *limitReader) read(p []byte) (int, error) {
+	if l.headOff < l.headN {
+		n := copy(p, l.head[l.headOff:l.headN])
+		l.headOff += n
+		return n, nil
+	}
+	if l.headErr != nil {
+		return 0, l.headErr
+	}
+	return l.dec.Read(p)
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if l.maxSize > 0 && int64(len(p)) > l.maxSize-l.n+1 {
+		p = p[:l.maxSize-l.n+1] // read one byte past the limit, so we know if the body's too big.
+	}
+	n, err := l.read(p)
+	l.n += int64(n)
+	switch {
+	case l.maxSize > 0 && l.n > l.maxSize:
+		n -= int(l.n - l.maxSize)
+	case l.maxRatio > 0 && l.n > ratioGrace && float64(l.n) > l.maxRatio*float64(l.compressed.n):
+	default:
+		return n, err
+	}
+	l.err = &TooLargeError{Encoding: l.encoding, MaxSize: l.maxSize, MaxRatio: l.maxRatio, Decompressed: l.n, Compressed: l.compressed.n}
+	if l.onLimit != nil {
+		l.onLimit(l.err)
+	}
+	return n, l.err
+}
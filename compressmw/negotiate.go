@@ -0,0 +1,127 @@
+// negotiate.go implements Accept-Encoding negotiation (RFC 9110 §12.5.3) for the response middleware.
+package compressmw
+
+import (
+	"strconv"
+	"strings"
+)
+
+// offer is a codec and the level to compress with.
+type offer struct {
+	c   *codec
+	lvl int
+}
+
+// acceptedCoding is one element of an Accept-Encoding header: a content-coding (or "*" or "identity") and its weight.
+type acceptedCoding struct {
+	coding string  // lowercase
+	q      float64 // 0 <= q <= 1
+}
+
+// parseAcceptEncoding parses the values of the Accept-Encoding headers, in order.
+// Elements with a malformed weight are dropped, as are empty elements. Parameters other than q are ignored.
+func parseAcceptEncoding(headers []string) []acceptedCoding {
+	var accepted []acceptedCoding
+	for _, h := range headers {
+		for _, elem := range strings.Split(h, ",") {
+			coding, params, _ := strings.Cut(elem, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+			q, ok := 1.0, true
+			for _, p := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(p, "=")
+				if strings.EqualFold(strings.TrimSpace(k), "q") {
+					q, ok = parseQ(strings.TrimSpace(v))
+				}
+			}
+			if ok {
+				accepted = append(accepted, acceptedCoding{coding: coding, q: q})
+			}
+		}
+	}
+	return accepted
+}
+
+// parseQ parses a weight: qvalue = ( "0" [ "." 0*3DIGIT ] ) / ( "1" [ "." 0*3("0") ] ).
+func parseQ(s string) (float64, bool) {
+	if s == "" || len(s) > len("0.000") || (s[0] != '0' && s[0] != '1') || (len(s) > 1 && s[1] != '.') {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// negotiate picks the content-coding for a response: the index into offers of the best codec the client accepts, or -1 for identity (no compression).
+// offers are in server preference order, which breaks ties between equal client weights.
+//
+//   - no Accept-Encoding header at all means identity: we don't compress for clients that didn't ask.
+//   - a codec's weight comes from its own token (or an alias, e.g, "x-gzip"), falling back to "*". q=0 refuses it.
+//   - identity is acceptable unless refused by "identity;q=0" or "*;q=0".
+//     It only beats a codec if the client explicitly weighs it higher (e.g, "identity, gzip;q=0.5").
+//
+// If the client refuses identity and every offer, we still send identity: that's more useful than a 406.
+func negotiate(headers []string, offers []offer) int { return negotiateOrder(headers, offers, false) }
+
+// negotiateOrder is negotiate, but if serverOrder is set, our order beats the client's weights: we pick the first offer the client accepts at all.
+// A client that weighs identity above every offer still gets identity.
+func negotiateOrder(headers []string, offers []offer, serverOrder bool) int {
+	if len(headers) == 0 {
+		return -1
+	}
+	accepted := parseAcceptEncoding(headers)
+
+	var (
+		star, identity = -1.0, -1.0 // -1: not mentioned
+		best, bestQ    = -1, 0.0
+		weights        = make([]float64, len(offers))
+		mentioned      = make([]bool, len(offers))
+	)
+	for _, a := range accepted {
+		switch a.coding {
+		case "*":
+			star = max(star, a.q)
+			continue
+		case "identity":
+			identity = max(identity, a.q)
+			continue
+		}
+		c := lookup(a.coding)
+		if c == nil {
+			continue
+		}
+		for i := range offers {
+			if offers[i].c.Name() == c.Name() { // not ==: a Compressor's brotli with its own window is a separate codec.
+				weights[i], mentioned[i] = max(weights[i], a.q), true
+			}
+		}
+	}
+	for i := range offers {
+		q := weights[i]
+		if !mentioned[i] && star >= 0 {
+			q = star
+		}
+		weights[i] = q
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	if identity < 0 {
+		identity = star // may still be -1: implicitly acceptable, but never preferred.
+	}
+	if best == -1 || identity > bestQ {
+		return -1
+	}
+	if serverOrder {
+		for i := range offers {
+			if weights[i] > 0 {
+				return i
+			}
+		}
+	}
+	return best
+}
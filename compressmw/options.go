@@ -0,0 +1,251 @@
+// options.go builds middleware from Options, returning an error for bad configuration instead of panicking:
+// use it when levels, encodings and limits come from config files or flags.
+// The struct types (Compressor, Decompressor, Transport) can still be filled in directly;
+// their Handler and Gin methods, and the Client/Server/Gin convenience functions, panic on bad configuration as they always have.
+package compressmw
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// An Option configures the middleware built by NewCompressor, NewDecompressor or NewTransport.
+// Each Option documents which of them it applies to; passing one elsewhere is an error.
+type Option struct {
+	name         string
+	compressor   func(*Compressor) error
+	decompressor func(*Decompressor) error
+	transport    func(*Transport) error
+}
+
+// WithEncodings sets the registered content-codings to use, most preferred first:
+// a Compressor's Encodings to offer, or a Decompressor's Encodings to decode.
+func WithEncodings(encodings ...string) Option {
+	return Option{
+		name:         "WithEncodings",
+		compressor:   func(cp *Compressor) error { cp.Encodings = encodings; return nil },
+		decompressor: func(d *Decompressor) error { d.Encodings = encodings; return nil },
+	}
+}
+
+// WithLevel sets the compression level for encoding, checked against its Codec's Levels: 0 or -1 select the default.
+// For a Compressor, it sets Levels[encoding]. For a Transport, it sets Encoding and Level: the request body is compressed with encoding at lvl.
+func WithLevel(encoding string, lvl int) Option {
+	return Option{
+		name: "WithLevel",
+		compressor: func(cp *Compressor) error {
+			if cp.Levels == nil {
+				cp.Levels = make(map[string]int)
+			}
+			cp.Levels[encoding] = lvl
+			return nil
+		},
+		transport: func(t *Transport) error { t.Encoding, t.Level = encoding, lvl; return nil },
+	}
+}
+
+// WithPreferOrder sets a Compressor's PreferOrder: its Encodings' order beats the client's weights.
+func WithPreferOrder() Option {
+	return Option{name: "WithPreferOrder", compressor: func(cp *Compressor) error { cp.PreferOrder = true; return nil }}
+}
+
+// WithBrotliWindow sets a Compressor's or Transport's BrotliWindow: the log2 of brotli's sliding window, from 10 to 24.
+func WithBrotliWindow(lgwin int) Option {
+	return Option{
+		name:       "WithBrotliWindow",
+		compressor: func(cp *Compressor) error { cp.BrotliWindow = lgwin; return nil },
+		transport:  func(t *Transport) error { t.BrotliWindow = lgwin; return nil },
+	}
+}
+
+// WithMinSize sets a Compressor's or Transport's MinSize: the smallest body worth compressing, in bytes.
+func WithMinSize(n int) Option {
+	check := func() error {
+		if n < 0 {
+			return fmt.Errorf("compressmw: WithMinSize: negative size %d", n)
+		}
+		return nil
+	}
+	return Option{
+		name:       "WithMinSize",
+		compressor: func(cp *Compressor) error { cp.MinSize = n; return check() },
+		transport:  func(t *Transport) error { t.MinSize = int64(n); return check() },
+	}
+}
+
+// WithContentTypes sets a Compressor's or Transport's ContentTypes: the only media types worth compressing.
+func WithContentTypes(patterns ...string) Option {
+	return Option{
+		name:       "WithContentTypes",
+		compressor: func(cp *Compressor) error { cp.ContentTypes = patterns; return nil },
+		transport:  func(t *Transport) error { t.ContentTypes = patterns; return nil },
+	}
+}
+
+// WithExcludedContentTypes sets a Compressor's or Transport's ExcludedContentTypes, replacing DefaultExcludedContentTypes.
+// With no patterns, every media type is compressed.
+func WithExcludedContentTypes(patterns ...string) Option {
+	if patterns == nil {
+		patterns = []string{} // nil would mean the defaults.
+	}
+	return Option{
+		name:       "WithExcludedContentTypes",
+		compressor: func(cp *Compressor) error { cp.ExcludedContentTypes = patterns; return nil },
+		transport:  func(t *Transport) error { t.ExcludedContentTypes = patterns; return nil },
+	}
+}
+
+// WithFlushBytes sets a Compressor's FlushBytes: the response is flushed after every n bytes the handler writes.
+func WithFlushBytes(n int) Option {
+	return Option{name: "WithFlushBytes", compressor: func(cp *Compressor) error {
+		if n < 0 {
+			return fmt.Errorf("compressmw: WithFlushBytes: negative size %d", n)
+		}
+		cp.FlushBytes = n
+		return nil
+	}}
+}
+
+// WithFlushInterval sets a Compressor's FlushInterval: the response is flushed once the handler's been quiet for d.
+func WithFlushInterval(d time.Duration) Option {
+	return Option{name: "WithFlushInterval", compressor: func(cp *Compressor) error {
+		if d < 0 {
+			return fmt.Errorf("compressmw: WithFlushInterval: negative interval %v", d)
+		}
+		cp.FlushInterval = d
+		return nil
+	}}
+}
+
+// WithFlushLines sets a Compressor's FlushLines: responses of these media types are flushed on every newline.
+// With no patterns, it uses StreamingContentTypes.
+func WithFlushLines(patterns ...string) Option {
+	if len(patterns) == 0 {
+		patterns = StreamingContentTypes
+	}
+	return Option{name: "WithFlushLines", compressor: func(cp *Compressor) error { cp.FlushLines = patterns; return nil }}
+}
+
+// WithRanges sets a Compressor's Ranges: how it serves Range requests.
+func WithRanges(policy RangePolicy) Option {
+	return Option{name: "WithRanges", compressor: func(cp *Compressor) error { cp.Ranges = policy; return nil }}
+}
+
+// WithMaxSize sets a Decompressor's MaxSize: the most a request body may decompress to, in bytes.
+func WithMaxSize(n int64) Option {
+	return Option{name: "WithMaxSize", decompressor: func(d *Decompressor) error {
+		if n < 0 {
+			return fmt.Errorf("compressmw: WithMaxSize: negative size %d", n)
+		}
+		d.MaxSize = n
+		return nil
+	}}
+}
+
+// WithMaxRatio sets a Decompressor's MaxRatio: how many decompressed bytes a request body may produce per compressed byte.
+func WithMaxRatio(ratio float64) Option {
+	return Option{name: "WithMaxRatio", decompressor: func(d *Decompressor) error {
+		if ratio < 0 {
+			return fmt.Errorf("compressmw: WithMaxRatio: negative ratio %g", ratio)
+		}
+		d.MaxRatio = ratio
+		return nil
+	}}
+}
+
+// WithRejectTooLarge sets a Decompressor's RejectTooLarge: bodies over MaxSize or MaxRatio get a 413 Request Entity Too Large.
+func WithRejectTooLarge() Option {
+	return Option{name: "WithRejectTooLarge", decompressor: func(d *Decompressor) error { d.RejectTooLarge = true; return nil }}
+}
+
+// WithRejectUnsupported sets a Decompressor's RejectUnsupported: requests with a coding it doesn't decode get a 415 Unsupported Media Type.
+func WithRejectUnsupported() Option {
+	return Option{name: "WithRejectUnsupported", decompressor: func(d *Decompressor) error { d.RejectUnsupported = true; return nil }}
+}
+
+// WithErrorHandler sets a Decompressor's ErrorHandler, which responds to request bodies that can't be decoded.
+func WithErrorHandler(h func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return Option{name: "WithErrorHandler", decompressor: func(d *Decompressor) error { d.ErrorHandler = h; return nil }}
+}
+
+// WithBase sets a Transport's Base: the RoundTripper that sends the compressed requests.
+func WithBase(rt http.RoundTripper) Option {
+	return Option{name: "WithBase", transport: func(t *Transport) error { t.Base = rt; return nil }}
+}
+
+// WithStreaming sets a Transport's Stream: request bodies are compressed as they're sent, rather than read into memory first.
+func WithStreaming() Option {
+	return Option{name: "WithStreaming", transport: func(t *Transport) error { t.Stream = true; return nil }}
+}
+
+// WithFallbackTTL sets a Transport's FallbackTTL: how long it remembers a host's content-coding after a 415.
+// A negative ttl sets DisableFallback instead: 415s are passed through and nothing is remembered.
+func WithFallbackTTL(ttl time.Duration) Option {
+	return Option{name: "WithFallbackTTL", transport: func(t *Transport) error {
+		t.FallbackTTL, t.DisableFallback = max(ttl, 0), ttl < 0
+		return nil
+	}}
+}
+
+// apply runs the Option for the middleware kind, erroring if it doesn't apply.
+func apply[T any](kind string, target *T, opts []Option, pick func(Option) func(*T) error) error {
+	for _, opt := range opts {
+		f := pick(opt)
+		if f == nil {
+			return fmt.Errorf("compressmw: %s doesn't apply to a %s", opt.name, kind)
+		}
+		if err := f(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewCompressor returns a Compressor configured by opts: WithEncodings, WithPreferOrder, WithLevel, WithBrotliWindow, WithMinSize, WithContentTypes, WithExcludedContentTypes,
+// WithFlushBytes, WithFlushInterval, WithFlushLines and WithRanges.
+// With no Encodings, it offers gzip. It returns an error for an unknown encoding, an invalid level, or an Option that doesn't apply.
+// Use its Handler method for net/http and its Gin method for gin.
+func NewCompressor(opts ...Option) (*Compressor, error) {
+	cp := &Compressor{Encodings: []string{"gzip"}}
+	if err := apply("Compressor", cp, opts, func(o Option) func(*Compressor) error { return o.compressor }); err != nil {
+		return nil, err
+	}
+	for encoding := range cp.Levels {
+		if !slices.Contains(cp.Encodings, encoding) {
+			return nil, fmt.Errorf("compressmw: WithLevel: %q isn't one of the Compressor's encodings %q", encoding, cp.Encodings)
+		}
+	}
+	if _, err := cp.policy(); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// NewDecompressor returns a Decompressor configured by opts: WithEncodings, WithMaxSize, WithMaxRatio, WithRejectTooLarge, WithRejectUnsupported and WithErrorHandler.
+// It returns an error for an unknown encoding, or an Option that doesn't apply.
+// Use its Handler method for net/http and its Gin method for gin.
+func NewDecompressor(opts ...Option) (*Decompressor, error) {
+	d := new(Decompressor)
+	if err := apply("Decompressor", d, opts, func(o Option) func(*Decompressor) error { return o.decompressor }); err != nil {
+		return nil, err
+	}
+	if _, err := d.policy(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewTransport returns a Transport configured by opts: WithBase, WithLevel, WithBrotliWindow, WithStreaming, WithFallbackTTL, WithMinSize, WithContentTypes and WithExcludedContentTypes.
+// It returns an error for an unknown encoding, an invalid level, or an Option that doesn't apply.
+func NewTransport(opts ...Option) (*Transport, error) {
+	t := new(Transport)
+	if err := apply("Transport", t, opts, func(o Option) func(*Transport) error { return o.transport }); err != nil {
+		return nil, err
+	}
+	if _, err := t.loadPolicy(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
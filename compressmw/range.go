@@ -0,0 +1,120 @@
+// range.go handles Range requests (RFC 9110 §14) to a Compressor.
+// A byte range of a compressed response is a range of the compressed bytes, not the original ones,
+// so it only makes sense if every response for that URL compresses identically: a file, not a page with a timestamp in it.
+package compressmw
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// A RangePolicy says how a Compressor treats Range requests.
+// Either way, a partial response the handler makes itself (206, or anything with a Content-Range) is never compressed.
+type RangePolicy int
+
+const (
+	// RangeIdentity serves Range requests uncompressed, so the handler's ranges (e.g, http.ServeContent's) are ranges of the original content.
+	RangeIdentity RangePolicy = iota
+	// RangeCompressed serves ranges of the compressed representation: the handler sees a plain GET,
+	// and the middleware compresses the whole response, then serves the requested range of it (with If-Range) like http.ServeContent.
+	// Compressed responses get a strong ETag for that representation ("v1" becomes "v1-gzip"), for If-Range to compare against.
+	// The whole response is held in memory, and never flushed early.
+	RangeCompressed
+)
+
+// rangeRequest is a Range request held back from the handler, for RangeCompressed.
+type rangeRequest struct {
+	r       *http.Request
+	rng     string        // the Range header
+	ifRange string        // the If-Range header
+	body    *bytes.Buffer // the whole response, compressed or not, from bufpool. nil once we've given up on serving a range.
+}
+
+// isPartial reports whether the handler has already made a partial response: compressing a slice of the content would be meaningless.
+func isPartial(status int, h http.Header) bool {
+	return status == http.StatusPartialContent || h.Get("Content-Range") != ""
+}
+
+// holdRange takes the Range (and If-Range) off a GET request, so the handler sends the whole content for us to compress and take a range of.
+func (cw *compressWriter) holdRange(r *http.Request) {
+	rng := r.Header.Get("Range")
+	if rng == "" || r.Method != http.MethodGet {
+		return
+	}
+	cw.rng = &rangeRequest{r: r, rng: rng, ifRange: r.Header.Get("If-Range"), body: getbuf()}
+	r.Header.Del("Range")
+	r.Header.Del("If-Range")
+}
+
+// capturing reports whether we're holding the response back to serve a range of it.
+func (cw *compressWriter) capturing() bool { return cw.rng != nil && cw.rng.body != nil }
+
+// releaseRange gives up on serving a range: the handler's response wasn't a complete 200, so it goes out as it is.
+func (cw *compressWriter) releaseRange() {
+	if cw.capturing() {
+		putbuf(cw.rng.body)
+		cw.rng.body = nil
+	}
+}
+
+// serveRange serves the requested range of the captured response, once the handler's done and the Encoder is closed.
+// http.ServeContent takes care of If-Range, multiple ranges, 416 Range Not Satisfiable, and Content-Length.
+func (cw *compressWriter) serveRange() {
+	rr := cw.rng
+	defer cw.releaseRange()
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		rr.r.Header.Del(name) // the handler's already evaluated these, against its own ETag.
+	}
+	rr.r.Header.Set("Range", rr.rng)
+	if rr.ifRange != "" {
+		rr.r.Header.Set("If-Range", rr.ifRange)
+	}
+	h := cw.Header()
+	h.Del("Content-Length")
+	modtime, _ := http.ParseTime(h.Get("Last-Modified"))
+	http.ServeContent(rangeWriter{cw.rw}, rr.r, "", modtime, bytes.NewReader(rr.body.Bytes()))
+}
+
+// rangeWriter is the ResponseWriter we give http.ServeContent to serve a compressed representation: serveRange's, or a FileServer's variant.
+// ServeContent's errors (416 Range Not Satisfiable, say) are plain text, not the compressed representation: they lose its Content-Encoding and ETag.
+type rangeWriter struct{ http.ResponseWriter }
+
+func (w rangeWriter) WriteHeader(code int) {
+	if (code < 200 || code > 299) && code != http.StatusNotModified { // a 304 describes the representation it's validating.
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("ETag")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// representationETag gives a compressed response a strong ETag of its own, distinct from the original's and from other codings':
+// "v1" becomes "v1-gzip". A weak ETag stays weak.
+func representationETag(h http.Header, coding string) {
+	etag := h.Get("ETag")
+	if !strings.HasSuffix(etag, `"`) || len(etag) < 2 {
+		return
+	}
+	h.Set("ETag", etag[:len(etag)-1]+"-"+coding+`"`)
+}
+
+// matchRepresentation strips the coding from the representation ETags in r's If-None-Match and If-Match,
+// so the handler compares them to its own ETag: a client revalidating "v1-gzip" has the gzip of "v1".
+func matchRepresentation(h http.Header, coding string) {
+	suffix := "-" + coding + `"`
+	for _, name := range []string{"If-None-Match", "If-Match"} {
+		vs := h.Values(name)
+		if len(vs) == 0 {
+			continue
+		}
+		etags := strings.Split(strings.Join(vs, ","), ",")
+		for i := range etags {
+			etag := strings.TrimSpace(etags[i])
+			if strings.HasSuffix(etag, suffix) {
+				etag = etag[:len(etag)-len(suffix)] + `"`
+			}
+			etags[i] = etag
+		}
+		h.Set(name, strings.Join(etags, ", "))
+	}
+}
@@ -1,116 +1,794 @@
 package compressmw
 
 import (
-	"compress/gzip"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// hasGzipAt returns the index of "gzip" or "x-gzip" in headers, or -1 if it's not present.
-// it splits on commas, so it can handle "br, gzip" or "gzip, br".
-// usually called as follows:
-func hasGzipAt(headers []string) int {
-	for i := range headers {
-		if !strings.Contains(headers[i], "gzip") {
-			continue
-		}
-		for _, v := range strings.Split(headers[i], ",") {
-			switch strings.TrimSpace(v) {
-			case "gzip", "x-gzip":
-				return i
+// compressWriter is an http.ResponseWriter that compresses everything written to it with the negotiated offer.
+// It holds back the status (and, with a minSize, up to minSize bytes of body) until it knows whether compressing is worth it:
+// that's decided by the first Write that fills the buffer, or when the handler returns.
+type compressWriter struct {
+	rw      http.ResponseWriter // the underlying ResponseWriter
+	p       *responsePolicy     // when to compress
+	o       offer               // the negotiated codec and level. the zero offer never compresses.
+	status  int                 // the HTTP response code from the first call to WriteHeader
+	decided bool                // whether we've picked compression or passthrough and written the status to rw
+	buf     *bytes.Buffer       // body held back while we decide, from bufpool
+	enc     Encoder             // non-nil once we've decided to compress: should wrap out()
+	rng     *rangeRequest       // a Range request we're serving from the compressed response: see range.go.
+
+	// auto-flushing: see flush.go.
+	mu        sync.Mutex  // serializes the handler's writes and flushes with the idle timer's
+	unflushed int         // bytes written since the last flush
+	timer     *time.Timer // flushes after p.flushInterval without a write. nil until the first write.
+	closed    bool        // the handler has returned, or hijacked the connection: nobody may touch rw.
+}
+
+// WriteHeader records the status code. It's written to the underlying ResponseWriter once we decide whether to compress.
+// Informational (1xx) responses like 103 Early Hints go straight through, since they don't determine the final status.
+func (cw *compressWriter) WriteHeader(code int) {
+	if informational(code) {
+		cw.rw.WriteHeader(code)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+}
+
+// informational reports whether code is a 1xx status that precedes the final response. 101 Switching Protocols is final.
+func informational(code int) bool {
+	return code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols
+}
+
+// bodyAllowed reports whether a response with this status may have content (RFC 9110 §6.4.1):
+// if it can't, there's nothing to compress, and a Content-Encoding or a compressed stream's framing would be a lie.
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status <= 199, status == http.StatusNoContent, status == http.StatusResetContent, status == http.StatusNotModified:
+		return false
+	default:
+		return true
+	}
+}
+
+// Write writes the compressed data to the underlying ResponseWriter, or buffers it until there's enough to be worth compressing.
+// Then it flushes, if the policy says to.
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.closed {
+		return 0, http.ErrHijacked
+	}
+	n, err := cw.write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, cw.autoflush(b[:n])
+}
+
+func (cw *compressWriter) write(b []byte) (int, error) {
+	cw.WriteHeader(http.StatusOK)
+	if !cw.decided {
+		if cw.buf == nil {
+			cw.buf = getbuf()
+		}
+		if cw.buffering() && cw.buf.Len()+len(b) < cw.p.minSize {
+			return cw.buf.Write(b)
+		}
+		if err := cw.decide(true, b); err != nil {
+			return 0, err
+		}
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.out().Write(b)
+}
+
+// out is where the response body goes: to rw, unless we're capturing it to serve a range of.
+func (cw *compressWriter) out() io.Writer {
+	if cw.capturing() {
+		return cw.rng.body
+	}
+	return cw.rw
+}
+
+// decide commits to compressing the response (or not), fixes up the headers to match, writes the status,
+// and then writes anything we've buffered so far. next is the write that prompted the decision, if any.
+//
+// Even if compress is true, we pass the body through unchanged if the status doesn't allow a body, the handler already encoded it,
+// or its Content-Type doesn't match the policy.
+func (cw *compressWriter) decide(compress bool, next []byte) error {
+	if cw.decided {
+		return nil
+	}
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if head := cw.head(next); len(head) > 0 {
+		if _, ok := h["Content-Type"]; !ok {
+			// sniff it ourselves: net/http would sniff the compressed bytes.
+			h.Set("Content-Type", http.DetectContentType(head))
+		}
+	}
+	compress = compress && cw.o.c != nil && bodyAllowed(cw.status) && !isPartial(cw.status, h) &&
+		h.Get("Content-Encoding") == "" && cw.p.types.match(h.Get("Content-Type"))
+	varyAcceptEncoding(h) // in case the handler replaced our Vary.
+	if compress {
+		h.Set("Content-Encoding", cw.o.c.Name())
+		h.Del("Content-Length") // the handler's length is for the uncompressed body.
+		if cw.p.ranges == RangeCompressed {
+			representationETag(h, cw.o.c.Name())
+		} else {
+			weakenETag(h)
+		}
+	} else if cw.status == http.StatusNotModified && cw.o.c != nil && cw.p.ranges == RangeCompressed && cw.p.types.match(h.Get("Content-Type")) {
+		representationETag(h, cw.o.c.Name()) // the client's copy is compressed: see matchRepresentation.
+	}
+	if cw.status != http.StatusOK {
+		cw.releaseRange() // only a complete response has ranges.
+	}
+	if !cw.capturing() {
+		cw.rw.WriteHeader(cw.status)
+	}
+	if compress {
+		cw.enc = cw.o.c.getwriter(cw.out(), cw.o.lvl)
+	}
+	if cw.buf == nil {
+		return nil
+	}
+	defer func() { putbuf(cw.buf); cw.buf = nil }()
+	if cw.enc != nil {
+		_, err := cw.enc.Write(cw.buf.Bytes())
+		return err
+	}
+	_, err := cw.out().Write(cw.buf.Bytes())
+	return err
+}
+
+// varyAcceptEncoding adds "Accept-Encoding" to the Vary header, unless it's already there, so caches don't serve compressed bodies to clients that didn't ask for them.
+func varyAcceptEncoding(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
 			}
 		}
-		// this should not be reachable, but particularly bad input could cause it.
-		// move on to the next header.
 	}
-	return -1 //
+	h.Add("Vary", "Accept-Encoding")
 }
 
-type gzipWriter struct {
-	gzipw  *gzip.Writer        // should wrap rw
-	rw     http.ResponseWriter // the underlying ResponseWriter
-	status int                 // the HTTP response code from the first call to WriteHeader
+// weakenETag turns a strong ETag into a weak one. A strong ETag promises byte-for-byte identical content,
+// which a compressed body isn't; weak comparison still lets If-None-Match revalidate it.
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
 }
 
-func checkgziplevel(lvl int) int {
-	switch lvl {
-	case gzip.DefaultCompression, 0:
-		return 6 // default to 6
-	case 1, 2, 3, 4, 5, 6, 7, 8, 9:
-		return lvl
-	default:
-		panic(fmt.Errorf("invalid gzip compression level: expected -1 <= level <= 9, got %d", lvl))
+// buffering reports whether we hold back the body until we see minSize bytes. There's no point if we're not going to compress.
+func (cw *compressWriter) buffering() bool { return cw.o.c != nil && cw.p.minSize > 0 }
+
+// head returns the start of the body: what we've buffered, or else next.
+func (cw *compressWriter) head(next []byte) []byte {
+	if cw.buf != nil && cw.buf.Len() > 0 {
+		return cw.buf.Bytes()
 	}
+	return next
 }
 
-// Write writes the compressed data to the underlying ResponseWriter.
-func (cw *gzipWriter) WriteHeader(code int) {
-	if cw.status != 0 {
+// close finishes the response once the handler returns. If we never saw minSize bytes, we send them uncompressed.
+// Otherwise, it flushes the end of the compressed stream and returns the Encoder to the pool.
+func (cw *compressWriter) close() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.closed { // hijacked.
 		return
 	}
-	cw.status = code
-	cw.rw.WriteHeader(code)
+	cw.closed = true
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	if !cw.decided && cw.buffering() && bodyAllowed(cw.status) && cw.Header().Get("Content-Length") == "" {
+		// we have the whole body: might as well say how long it is.
+		n := 0
+		if cw.buf != nil {
+			n = cw.buf.Len()
+		}
+		cw.Header().Set("Content-Length", strconv.Itoa(n))
+	}
+	cw.decide(!cw.buffering(), nil)
+	if cw.enc != nil {
+		cw.o.c.putwriter(cw.enc, cw.o.lvl)
+		cw.enc = nil
+	}
+	if cw.capturing() {
+		cw.serveRange()
+	}
 }
 
-func (cw *gzipWriter) Write(b []byte) (int, error) {
+// FlushError sends everything written so far to the client: it commits to compressing (or not) if we haven't yet,
+// sync-flushes the Encoder so the client can decode every byte written, and then flushes the underlying ResponseWriter.
+// A handler streaming server-sent events or NDJSON gets here through http.ResponseController or http.Flusher.
+func (cw *compressWriter) FlushError() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.flush()
+}
+
+func (cw *compressWriter) flush() error {
+	cw.unflushed = 0
 	cw.WriteHeader(http.StatusOK)
-	return cw.gzipw.Write(b)
+	if err := cw.decide(true, nil); err != nil {
+		return err
+	}
+	if cw.capturing() { // nothing goes out until we have the whole response.
+		return nil
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.rw).Flush()
+}
+
+// Flush implements http.Flusher: see FlushError.
+func (cw *compressWriter) Flush() { cw.FlushError() }
+
+// Hijack lets the handler take over the connection, as for a WebSocket: the middleware abandons compression and never touches it again.
+// Anything written so far goes out first, as net/http does, uncompressed if we hadn't started compressing yet.
+// If we had, the Encoder goes back to the pool without writing the end of the stream into the hijacked connection.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.releaseRange()
+	if !cw.decided && (cw.status != 0 || (cw.buf != nil && cw.buf.Len() > 0)) {
+		if err := cw.decide(false, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	conn, brw, err := http.NewResponseController(cw.rw).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	cw.closed = true
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	if cw.buf != nil {
+		putbuf(cw.buf)
+		cw.buf = nil
+	}
+	if cw.enc != nil {
+		cw.enc.Reset(io.Discard) // so putwriter's Close writes the end of the stream nowhere.
+		cw.o.c.putwriter(cw.enc, cw.o.lvl)
+		cw.enc = nil
+	}
+	return conn, brw, nil
 }
 
 // Header returns the header map of the underlying ResponseWriter.
-func (cw *gzipWriter) Header() http.Header { return cw.rw.Header() }
+func (cw *compressWriter) Header() http.Header { return cw.rw.Header() }
 
-// ServerAcceptGzip transparently decompresses incoming requests with a Content-Encoding of "gzip" or "x-gzip".
-// It does not handle "deflate", "br", "zstd", or any other encoding - use separate middleware for those.
-// See ServerGzipBodies for compressing outgoing responses,
-// and ClientCompressBodyWithGzip for compressing outgoing requests to be READ by this middleware.
-func ServerAcceptGzip(h http.Handler) http.HandlerFunc {
+// Unwrap returns the underlying ResponseWriter.
+func (cw *compressWriter) Unwrap() http.ResponseWriter { return cw.rw }
+
+// A Decompressor transparently decompresses request bodies whose Content-Encoding is a registered Codec,
+// optionally limiting how far they may expand. Use Handler for net/http and Gin for gin.
+type Decompressor struct {
+	// Encodings are the registered content-codings to decode. Empty means any registered Codec.
+	// Codings are removed from the end of Content-Encoding (the last one applied) back, as long as they're in Encodings.
+	// Whatever's left stays in the header, so a request stacked with other codings can go through other middleware,
+	// unless nothing else could decode it: a request whose last coding isn't registered at all, or that has one of Encodings
+	// beneath a coding we can't decode ("gzip, br" to a gzip-only Decompressor), is unsupported, as with RejectUnsupported.
+	Encodings []string
+	// RejectUnsupported makes the Decompressor own the whole Content-Encoding header: a request with any coding outside Encodings
+	// goes to the ErrorHandler with an *UnsupportedEncodingError, and gets a 415 Unsupported Media Type by default.
+	RejectUnsupported bool
+	// MaxSize limits the decompressed size of a request body, in bytes. 0 means no limit.
+	MaxSize int64
+	// MaxRatio limits how many decompressed bytes a body may produce per compressed byte. 0 means no limit.
+	// It's enforced once the body has decompressed past 1 MiB, so small, highly-repetitive bodies aren't rejected.
+	MaxRatio float64
+	// Once a body exceeds MaxSize or MaxRatio, reading it fails with a *TooLargeError.
+	// If RejectTooLarge is set, the middleware also responds 413 Request Entity Too Large (unless the handler has already started its response),
+	// and discards whatever the handler writes afterwards.
+	RejectTooLarge bool
+	// ErrorHandler responds to requests whose body can't be decoded at all: with a *DecodeError for, e.g, a corrupt gzip header,
+	// or an *UnsupportedEncodingError for a content-coding the Decompressor doesn't decode and won't leave for other middleware. The request never reaches the handler.
+	// nil responds 400 Bad Request, or 415 Unsupported Media Type for an unsupported coding, with the error.
+	// Either way, a 415 lists the codings we do decode in its Accept-Encoding header (RFC 7694).
+	// Corruption later in the stream is still reported to the handler by Read.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// requestPolicy is a Decompressor, checked and ready to use.
+type requestPolicy struct {
+	codecs       []*codec // empty for any registered codec
+	strict       bool     // RejectUnsupported
+	maxSize      int64
+	maxRatio     float64
+	reject       bool
+	errorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// rejectRequest is the default Decompressor.ErrorHandler.
+func rejectRequest(w http.ResponseWriter, r *http.Request, err error) {
+	var unsupported *UnsupportedEncodingError
+	if errors.As(err, &unsupported) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// fail hands a request decodeRequest couldn't decode to the ErrorHandler, telling the client what we can decode if that's the problem.
+func (p *requestPolicy) fail(w http.ResponseWriter, r *http.Request, err error) {
+	var unsupported *UnsupportedEncodingError
+	if errors.As(err, &unsupported) {
+		w.Header().Set("Accept-Encoding", strings.Join(unsupported.Accepted, ", "))
+	}
+	p.errorHandler(w, r, err)
+}
+
+// policy looks up d.Encodings.
+func (d *Decompressor) policy() (*requestPolicy, error) {
+	codecs := make([]*codec, len(d.Encodings))
+	for i := range d.Encodings {
+		c, err := lookupEncoding(d.Encodings[i])
+		if err != nil {
+			return nil, err
+		}
+		codecs[i] = c
+	}
+	p := &requestPolicy{codecs: codecs, strict: d.RejectUnsupported, maxSize: max(d.MaxSize, 0), maxRatio: max(d.MaxRatio, 0), reject: d.RejectTooLarge, errorHandler: d.ErrorHandler}
+	if p.errorHandler == nil {
+		p.errorHandler = rejectRequest
+	}
+	return p, nil
+}
+
+// mustPolicy is policy for middleware constructors: it panics on an unknown encoding.
+func (d *Decompressor) mustPolicy() *requestPolicy {
+	p, err := d.policy()
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// accepts returns the codec for the content-coding token, or nil if p doesn't decode it.
+func (p *requestPolicy) accepts(token string) *codec {
+	c := lookup(token)
+	if c == nil || len(p.codecs) == 0 {
+		return c
+	}
+	for _, want := range p.codecs {
+		if c == want {
+			return c
+		}
+	}
+	return nil
+}
+
+// accepted lists the content-codings p decodes.
+func (p *requestPolicy) accepted() []string {
+	if len(p.codecs) == 0 {
+		return registeredEncodings()
+	}
+	names := make([]string, len(p.codecs))
+	for i, c := range p.codecs {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// decodeRequest replaces r.Body with a streaming, decompressing (and limiting) reader, if it has a Content-Encoding p decodes.
+// Codings are listed in the order they were applied, so it removes them in reverse: "gzip, br" is brotli of gzip.
+// It removes the ones it decodes from the header, which goes once they're all gone: we don't want something later down the line to do it again.
+// Call the returned func once the handler's done, to close the original body and return the Decoders to the pool.
+//
+// A coding p doesn't decode stops it there, leaving that coding and any before it for other middleware,
+// unless p is strict: then, it returns an *UnsupportedEncodingError without decoding anything.
+// If the body can't be decoded at all, it returns a *DecodeError. Either way, it leaves the request alone.
+// stuck reports whether the codings we'd leave in the header, the last of which we can't decode, could never reach the handler decoded:
+// no middleware in this package decodes an unregistered coding, and a layer we decode beneath one we can't would need us to run again.
+func (p *requestPolicy) stuck(rest []string) bool {
+	if lookup(rest[len(rest)-1]) == nil {
+		return true
+	}
+	for _, coding := range rest[:len(rest)-1] {
+		if p.accepts(coding) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *requestPolicy) decodeRequest(r *http.Request) (body *limitReader, done func(), err error) {
+	codings := contentCodings(r.Header.Values("Content-Encoding"))
+	k := len(codings) // codings[k:] are the ones we decode.
+	for k > 0 && p.accepts(codings[k-1]) != nil {
+		k--
+	}
+	if k > 0 && (p.strict || p.stuck(codings[:k])) {
+		return nil, func() {}, &UnsupportedEncodingError{Encoding: codings[k-1], Accepted: p.accepted()}
+	}
+	if k == len(codings) {
+		return nil, func() {}, nil
+	}
+	rest, codings := codings[:k], codings[k:]
+	layers := make([]*codec, len(codings))
+	for i, coding := range codings {
+		layers[i] = p.accepts(coding)
+	}
+
+	orig := r.Body
+	compressed := &countReader{r: orig}
+	decs := make([]Decoder, 0, len(layers))
+	release := func() {
+		for i, dec := range decs {
+			layers[len(layers)-1-i].putreader(dec)
+		}
+	}
+	var src io.Reader = compressed
+	for i := len(layers) - 1; i >= 0; i-- {
+		dec, err := layers[i].getreader(src)
+		if err != nil {
+			release()
+			return nil, func() {}, &DecodeError{Encoding: layers[i].Name(), Err: err}
+		}
+		decs = append(decs, dec)
+		src = dec
+	}
+	encoding := strings.Join(codings, ", ")
+	body = &limitReader{dec: src, compressed: compressed, encoding: encoding, maxSize: p.maxSize, maxRatio: p.maxRatio}
+	if err := body.prime(); err != nil {
+		release()
+		return nil, func() {}, &DecodeError{Encoding: encoding, Err: err}
+	}
+	if len(rest) > 0 {
+		r.Header.Set("Content-Encoding", strings.Join(rest, ", "))
+	} else {
+		r.Header.Del("Content-Encoding")
+	}
+	// the Content-Length is the compressed body's: we don't know the decoded length until the handler reads it all.
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	r.Body = io.NopCloser(body) // the Decoders go back in the pool: don't let the handler close them.
+	return body, func() {
+		orig.Close()
+		release()
+	}, nil
+}
+
+// Handler decompresses the request bodies of h. It panics if an encoding isn't registered.
+func (d *Decompressor) Handler(h http.Handler) http.HandlerFunc {
+	p := d.mustPolicy()
 	return func(w http.ResponseWriter, r *http.Request) {
-		i := hasGzipAt(r.Header.Values("Content-Encoding"))
-		if i == -1 { // not gzip-encoded. pass it through.
-			h.ServeHTTP(w, r)
+		body, done, err := p.decodeRequest(r)
+		if err != nil {
+			p.fail(w, r, err)
 			return
 		}
-		// remove 'content-encoding: gzip' from the header: we don't want something later down the line to do it again.
-		r.Header["Content-Encoding"] = append(r.Header["Content-Encoding"][:i], r.Header["Content-Encoding"][i+1:]...)
+		defer done()
+		if body != nil && p.reject {
+			rw := &rejectWriter{ResponseWriter: w}
+			body.onLimit = rw.reject
+			w = rw
+		}
+		h.ServeHTTP(w, r)
+	}
+}
 
-		// replace the request body with a streaming, decompressing reader.
-		defer r.Body.Close()
-		zipreader := getzipreader(r.Body)
-		defer putzipreader(zipreader)
-		r.Body = zipreader
+// rejectWriter responds 413 Request Entity Too Large when the request body trips a Decompressor's limits,
+// as long as the handler hasn't already started its response. After that, the handler's writes are discarded.
+type rejectWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	err         error // non-nil once we've rejected the request
+}
 
-		h.ServeHTTP(w, r)
+func (rw *rejectWriter) WriteHeader(code int) {
+	if rw.err != nil || rw.wroteHeader {
+		return
+	}
+	if !informational(code) {
+		rw.wroteHeader = true
 	}
+	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *rejectWriter) Write(b []byte) (int, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(b)
+}
+
+// reject responds 413, if it's not too late.
+func (rw *rejectWriter) reject(err error) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader, rw.err = true, err
+	rw.Header().Set("Connection", "close") // there's no point reading the rest of the body.
+	http.Error(rw.ResponseWriter, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+}
+
+// Unwrap returns the underlying ResponseWriter.
+func (rw *rejectWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+// FlushError flushes the underlying ResponseWriter, for a streaming handler. It's too late to reject the request after that.
+func (rw *rejectWriter) FlushError() error {
+	if rw.err != nil {
+		return rw.err
+	}
+	rw.wroteHeader = true
+	return http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Flush implements http.Flusher: see FlushError.
+func (rw *rejectWriter) Flush() { rw.FlushError() }
+
+// Hijack lets the handler take over the connection, if the underlying ResponseWriter can. We never write to it after that.
+func (rw *rejectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.err != nil {
+		return nil, nil, rw.err
+	}
+	rw.wroteHeader = true
+	return http.NewResponseController(rw.ResponseWriter).Hijack()
+}
+
+// ServerAcceptCompressed transparently decompresses incoming requests whose Content-Encoding is one of encodings,
+// leaving other registered codings applied after them for other middleware: see Decompressor.Encodings for when it responds 415 Unsupported Media Type instead.
+// With no encodings, it decodes any registered Codec, and owns the whole header: requests with an unregistered coding get a 415. It panics if an encoding isn't registered.
+// See Decompressor for limiting how far bodies may expand, ServerCompressResponseBody for compressing outgoing responses,
+// and ClientCompressBody for compressing outgoing requests to be READ by this middleware.
+func ServerAcceptCompressed(h http.Handler, encodings ...string) http.HandlerFunc {
+	return (&Decompressor{Encodings: encodings, RejectUnsupported: len(encodings) == 0}).Handler(h)
+}
+
+// A Compressor compresses response bodies with the best of its Encodings that the client accepts,
+// negotiated from the request's Accept-Encoding header by q-value (RFC 9110 §12.5.3).
+// Use Handler for net/http and Gin for gin.
+type Compressor struct {
+	// Encodings are the registered content-codings to offer, most preferred first.
+	// The client's weights win: our order only breaks ties, unless PreferOrder is set.
+	Encodings []string
+	// PreferOrder picks the first of Encodings the client accepts at all (q > 0), whatever its weights:
+	// e.g, br for a client sending "gzip, br;q=0.5" to a Compressor preferring br.
+	PreferOrder bool
+	// Levels maps an encoding to its compression level. Missing encodings, 0 and -1 use the Codec's default.
+	Levels map[string]int
+	// BrotliWindow is the log2 of brotli's sliding window for "br", from 10 to 24. 0 means brotli's default of 22 (4 MiB).
+	// A smaller window saves memory on both ends, at some cost in compression.
+	BrotliWindow int
+	// MinSize is the smallest body worth compressing: compression framing makes tiny bodies bigger.
+	// The middleware buffers up to MinSize bytes (and the status) before deciding;
+	// if the handler finishes first, the body is sent uncompressed with its Content-Length. 0 compresses every body.
+	MinSize int
+	// ContentTypes, if non-empty, limits compression to responses whose Content-Type matches one of these media types.
+	// Patterns are exact ("application/json") or wildcards ("text/*", "*/*"); parameters like charset are ignored.
+	// If the handler doesn't set a Content-Type, it's sniffed from the body, like net/http does.
+	ContentTypes []string
+	// ExcludedContentTypes are never compressed, even if they match ContentTypes.
+	// nil means DefaultExcludedContentTypes; use an empty, non-nil slice to compress every type.
+	ExcludedContentTypes []string
+
+	// Streaming handlers can flush the response themselves (see FlushError), or have the middleware do it.
+	// Any of these, if set, flushes the response, compressed or not:
+
+	// FlushBytes flushes after every FlushBytes bytes the handler writes, counted before compression.
+	FlushBytes int
+	// FlushInterval flushes once the handler has written something and then gone quiet for FlushInterval.
+	// It never flushes a response MinSize is still buffering: until the handler writes MinSize bytes (or flushes), it can still set headers.
+	// Streaming handlers whose first events are smaller than MinSize want FlushBytes or FlushLines, which flush from the handler's own writes.
+	FlushInterval time.Duration
+	// FlushLines flushes after every write containing a newline, if the response's Content-Type matches one of these patterns:
+	// use StreamingContentTypes for server-sent events and NDJSON.
+	FlushLines []string
+
+	// Ranges says how to serve Range requests: uncompressed (the default), or as ranges of the compressed response.
+	// It applies to every route behind this Compressor: give routes that serve files a Compressor of their own to use RangeCompressed.
+	Ranges RangePolicy
+}
+
+// responsePolicy is a Compressor, checked and ready to use.
+type responsePolicy struct {
+	offers        []offer
+	serverOrder   bool // PreferOrder
+	minSize       int
+	types         mediaTypes
+	flushBytes    int
+	flushInterval time.Duration
+	flushLines    *mediaTypes // nil: don't flush on newlines
+	ranges        RangePolicy
+}
+
+// policy looks up cp.Encodings and checks their Levels.
+func (cp *Compressor) policy() (*responsePolicy, error) {
+	offers := make([]offer, len(cp.Encodings))
+	for i, encoding := range cp.Encodings {
+		c, err := lookupEncoding(encoding)
+		if err != nil {
+			return nil, err
+		}
+		lvl, err := c.level(cp.Levels[encoding])
+		if err != nil {
+			return nil, err
+		}
+		if c, err = c.withBrotliWindow(cp.BrotliWindow); err != nil {
+			return nil, err
+		}
+		offers[i] = offer{c: c, lvl: lvl}
+	}
+	if cp.Ranges != RangeIdentity && cp.Ranges != RangeCompressed {
+		return nil, fmt.Errorf("compressmw: unknown RangePolicy %d", cp.Ranges)
+	}
+	return &responsePolicy{
+		offers:      offers,
+		serverOrder: cp.PreferOrder,
+		minSize:     max(cp.MinSize, 0),
+		types:       newMediaTypes(cp.ContentTypes, cp.ExcludedContentTypes),
+
+		flushBytes:    max(cp.FlushBytes, 0),
+		flushInterval: max(cp.FlushInterval, 0),
+		flushLines:    flushLines(cp.FlushLines),
+		ranges:        cp.Ranges,
+	}, nil
+}
+
+// mustPolicy is policy for middleware constructors: it panics on an unknown encoding or invalid level.
+func (cp *Compressor) mustPolicy() *responsePolicy {
+	p, err := cp.policy()
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// isUpgrade reports whether r asks to switch protocols: "Connection: upgrade" with an Upgrade header.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negotiateRequest picks the offer for r, removing the Accept-Encoding header if it picks one: we don't want something later down the line to compress again.
+// The zero offer means identity: don't compress. So do HEAD requests, which have no body to compress,
+// protocol upgrades (e.g, WebSockets), whose connection the handler takes over, and Range requests under RangeIdentity.
+func (p *responsePolicy) negotiateRequest(r *http.Request) offer {
+	if r.Method == http.MethodHead || isUpgrade(r) || (p.ranges == RangeIdentity && r.Header.Get("Range") != "") {
+		return offer{}
+	}
+	i := negotiateOrder(r.Header.Values("Accept-Encoding"), p.offers, p.serverOrder)
+	if i == -1 {
+		return offer{}
+	}
+	r.Header.Del("Accept-Encoding")
+	return p.offers[i]
+}
+
+// start negotiates the response to r. Under RangeCompressed, it also holds back its Range for us to serve.
+func (cw *compressWriter) start(r *http.Request) {
+	cw.o = cw.p.negotiateRequest(r)
+	if cw.o.c != nil && cw.p.ranges == RangeCompressed {
+		matchRepresentation(r.Header, cw.o.c.Name())
+		cw.holdRange(r)
+	}
+}
+
+// Handler compresses the responses of h. It panics if an encoding isn't registered or a level is out of range.
+// Responses to HEAD requests, and responses whose status forbids a body (1xx, 204, 205, 304) are never compressed.
+//
+// Every response gets "Vary: Accept-Encoding". Compressed responses also lose the handler's Content-Length, and a strong ETag is weakened.
+func (cp *Compressor) Handler(h http.Handler) http.HandlerFunc {
+	p := cp.mustPolicy()
+	return func(w http.ResponseWriter, r *http.Request) {
+		// replace the response writer with a streaming, compressing writer.
+		// even if we're not compressing, it fixes up the headers.
+		cw := &compressWriter{rw: w, p: p}
+		cw.start(r)
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	}
+}
+
+// ServerCompressResponseBody compresses outgoing responses with the registered Codec named by encoding, if the client accepts it.
+// That is, if the client sends "Accept-Encoding: <encoding>" (with a nonzero q-value) in the request header,
+// the response body will be compressed and sent with "Content-Encoding: <encoding>" in the response header.
+// Level is checked against the Codec's Levels: 0 or -1 select its default.
+// It panics if encoding isn't registered or the level is out of range.
+// See Compressor for offering several encodings.
+func ServerCompressResponseBody(h http.Handler, encoding string, lvl int) http.HandlerFunc {
+	return (&Compressor{Encodings: []string{encoding}, Levels: map[string]int{encoding: lvl}}).Handler(h)
+}
+
+// ServerAcceptGzip transparently decompresses incoming requests with a Content-Encoding of "gzip" or "x-gzip".
+// It does not handle "deflate", "br", "zstd", or any other encoding - see ServerAcceptCompressed for those.
+// Codings applied before the gzip layers it removes ("zstd, gzip"), or instead of them ("zstd"), are left for other middleware like ServerAcceptZstd.
+// But a gzip layer beneath one it can't decode ("gzip, br"), or an unregistered coding applied last ("compress"),
+// gets a 415 Unsupported Media Type with Accept-Encoding: gzip: no other middleware would decode the request for the handler.
+// See ServerGzipResponseBody for compressing outgoing responses,
+// and ClientGzipBody for compressing outgoing requests to be READ by this middleware.
+func ServerAcceptGzip(h http.Handler) http.HandlerFunc { return ServerAcceptCompressed(h, "gzip") }
+
 // ServerGzipResponseBody compresses outgoing responses with gzip if the client accepts it.
 // That is, if the client sends "Accept-Encoding: gzip" in the request header,
 // the response body will be compressed with gzip and sent with "Content-Encoding: gzip" in the response header.
 // Level is in the range 1(gzip.BestSpeed) to 9(gzip.BestCompression). 0 or -1 default to 6
 //
-// See ServerAcceptGzip for decompressing incoming requests, and ClientCompressBodyWithGzip for compressing outgoing requests.
-// This does not handle "deflate", "br", "zstd", or any other encoding - use separate middleware for those.
+// See ServerAcceptGzip for decompressing incoming requests, and ClientGzipBody for compressing outgoing requests.
+// This does not handle "deflate", "br", "zstd", or any other encoding - see ServerCompressResponseBody for those.
 func ServerGzipResponseBody(h http.Handler, lvl int) http.HandlerFunc {
-	lvl = checkgziplevel(lvl)
-	return func(w http.ResponseWriter, r *http.Request) {
-		acceptEncoding := r.Header.Values("Accept-Encoding")
-		i := hasGzipAt(acceptEncoding)
-		if i == -1 {
-			// we didn't find a gzip encoding, so we can skip the rest of this middleware.
-			h.ServeHTTP(w, r)
-			return
-		}
-		// remove 'accept-encoding: gzip' from the header: we don't want something later down the line to do it again.
-		r.Header["Accept-Encoding"] = append(acceptEncoding[:i], acceptEncoding[i+1:]...)
-		w.Header().Add("Content-Encoding", "gzip")
-		// replace the response writer with a streaming, compressing writer.
-		gzipw := getzipwriter(w, lvl)
-		defer putzipwriter(gzipw, lvl)
-		h.ServeHTTP(&gzipWriter{rw: w, gzipw: gzipw}, r)
-	}
+	return ServerCompressResponseBody(h, "gzip", lvl)
 }
 
-// Unwrap returns the underlying ResponseWriter.
-func (cw *gzipWriter) Unwrap() http.ResponseWriter { return cw.rw }
+// ServerAcceptZstd transparently decompresses incoming requests with a Content-Encoding of "zstd".
+// See ServerAcceptGzip for the gzip equivalent, ServerZstdResponseBody for compressing outgoing responses,
+// and ClientZstdBody for compressing outgoing requests to be READ by this middleware.
+func ServerAcceptZstd(h http.Handler) http.HandlerFunc { return ServerAcceptCompressed(h, "zstd") }
+
+// ServerZstdResponseBody compresses outgoing responses with zstd if the client sends "Accept-Encoding: zstd".
+// Level is in the range 1(zstd.SpeedFastest) to 4(zstd.SpeedBestCompression). 0 or -1 default to 2(zstd.SpeedDefault).
+//
+// See ServerGzipResponseBody for the gzip equivalent.
+func ServerZstdResponseBody(h http.Handler, lvl int) http.HandlerFunc {
+	return ServerCompressResponseBody(h, "zstd", lvl)
+}
+
+// ServerAcceptBrotli transparently decompresses incoming requests with a Content-Encoding of "br".
+// See ServerAcceptGzip for the gzip equivalent, ServerBrotliResponseBody for compressing outgoing responses,
+// and ClientBrotliBody for compressing outgoing requests to be READ by this middleware.
+func ServerAcceptBrotli(h http.Handler) http.HandlerFunc { return ServerAcceptCompressed(h, "br") }
+
+// ServerBrotliResponseBody compresses outgoing responses with brotli if the client sends "Accept-Encoding: br".
+// Quality is in the range 1 to 11(brotli.BestCompression). 0 or -1 default to 6(brotli.DefaultCompression).
+// Use a Compressor to set the window size, or to offer gzip to clients without brotli.
+//
+// See ServerGzipResponseBody for the gzip equivalent.
+func ServerBrotliResponseBody(h http.Handler, quality int) http.HandlerFunc {
+	return ServerCompressResponseBody(h, "br", quality)
+}
+
+// ServerAcceptDeflate transparently decompresses incoming requests with a Content-Encoding of "deflate", whether zlib-wrapped or raw.
+// See ServerAcceptGzip for the gzip equivalent, ServerDeflateResponseBody for compressing outgoing responses,
+// and ClientDeflateBody for compressing outgoing requests to be READ by this middleware.
+func ServerAcceptDeflate(h http.Handler) http.HandlerFunc {
+	return ServerAcceptCompressed(h, "deflate")
+}
+
+// ServerDeflateResponseBody compresses outgoing responses with deflate (zlib-wrapped, per RFC 9110) if the client sends "Accept-Encoding: deflate".
+// Level is in the range 1(flate.BestSpeed) to 9(flate.BestCompression). 0 or -1 default to 6.
+// Most clients that accept deflate accept gzip too, which has fewer interoperability problems: a Compressor offering gzip, then deflate, serves both.
+//
+// See ServerGzipResponseBody for the gzip equivalent.
+func ServerDeflateResponseBody(h http.Handler, lvl int) http.HandlerFunc {
+	return ServerCompressResponseBody(h, "deflate", lvl)
+}
@@ -0,0 +1,132 @@
+// static.go serves static files, preferring precompressed variants built ahead of time (e.g, app.js.br next to app.js).
+// Compressing at build time, at the best level, beats compressing every response on the fly at a fast one.
+package compressmw
+
+import (
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A FileServer serves the files in FS, like http.FileServer.
+// When a client accepts one of Encodings and a sibling variant exists ("file.br", "file.zst", "file.gz"; "file.<name>" for other codecs),
+// it serves the variant as-is with that Content-Encoding, the original file's Content-Type, and the variant's Content-Length and ETag,
+// supporting Range and conditional requests against it. Otherwise, it serves the original file through Compressor.
+// A variant whose original doesn't exist is never served: "file.gz" alone is not "file".
+type FileServer struct {
+	// FS holds the files and their variants.
+	FS fs.FS
+	// Encodings are the registered content-codings to look for variants of, most preferred first. Empty means br, zstd, gzip.
+	// The client's weights win: our order only breaks ties.
+	Encodings []string
+	// Compressor compresses files without a variant on the fly. nil means gzip at its default level;
+	// a Compressor without Encodings serves them uncompressed.
+	Compressor *Compressor
+}
+
+// variantSuffix is the file extension for variants compressed with c.
+func variantSuffix(c *codec) string {
+	switch c.Name() {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	default:
+		return "." + c.Name()
+	}
+}
+
+// Handler returns an http.Handler serving fsrv.FS. It panics if an encoding isn't registered or the Compressor is invalid.
+func (fsrv *FileServer) Handler() http.Handler {
+	encodings := fsrv.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultAcceptEncodings
+	}
+	codecs := make([]*codec, len(encodings))
+	for i := range encodings {
+		c, err := lookupEncoding(encodings[i])
+		if err != nil {
+			panic(err)
+		}
+		codecs[i] = c
+	}
+	cp := fsrv.Compressor
+	if cp == nil {
+		cp = &Compressor{Encodings: []string{"gzip"}}
+	}
+	fallback := cp.Handler(http.FileServer(http.FS(fsrv.FS)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		varyAcceptEncoding(w.Header()) // whether or not there's a variant of this file today, the response depends on Accept-Encoding.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+		if name == "" || !fsrv.serveVariant(w, r, name, codecs) {
+			fallback.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveVariant serves the best precompressed variant of name the client accepts, if there is one. It reports whether it did.
+func (fsrv *FileServer) serveVariant(w http.ResponseWriter, r *http.Request, name string, codecs []*codec) bool {
+	if info, err := fs.Stat(fsrv.FS, name); err != nil || !info.Mode().IsRegular() {
+		return false // a variant of nothing: the fallback 404s (or lists the directory).
+	}
+	// only offer the codecs we have a variant for.
+	var offers []offer
+	var infos []fs.FileInfo
+	for _, c := range codecs {
+		info, err := fs.Stat(fsrv.FS, name+variantSuffix(c))
+		if err == nil && info.Mode().IsRegular() {
+			offers, infos = append(offers, offer{c: c}), append(infos, info)
+		}
+	}
+	if len(offers) == 0 {
+		return false
+	}
+	i := negotiate(r.Header.Values("Accept-Encoding"), offers)
+	if i == -1 {
+		return false
+	}
+	c, info := offers[i].c, infos[i]
+	f, err := fsrv.FS.Open(name + variantSuffix(c))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	h := w.Header()
+	h.Set("Content-Encoding", c.Name())
+	h.Set("Content-Type", fsrv.contentType(name))
+	// a strong ETag for this representation: each variant is byte-for-byte different from the original, and from each other.
+	h.Set("ETag", `"`+strconv.FormatInt(info.ModTime().UnixNano(), 36)+"-"+strconv.FormatInt(info.Size(), 36)+"-"+c.Name()+`"`)
+	http.ServeContent(rangeWriter{w}, r, name, info.ModTime(), content)
+	return true
+}
+
+// contentType is the Content-Type of the original file: from its extension, or else sniffed from its content.
+func (fsrv *FileServer) contentType(name string) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	f, err := fsrv.FS.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+	return http.DetectContentType(buf[:n])
+}
@@ -1,8 +1,18 @@
 package compressmw
 
-import "testing"
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
 
-func TestHasGzipAt(t *testing.T) {
+func TestCodecAt(t *testing.T) {
+	gzip := lookup("gzip")
 	for _, tt := range []struct {
 		name   string
 		header []string
@@ -27,11 +37,180 @@ func TestHasGzipAt(t *testing.T) {
 			header: []string{"0", "1", "br, x-gzip"},
 			want:   2,
 		},
+		{
+			name:   "only zstd",
+			header: []string{"zstd"},
+			want:   -1,
+		},
+		{
+			name:   "case and whitespace",
+			header: []string{"br", " GZip "},
+			want:   1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := codecAt(tt.header, []*codec{gzip}); got != tt.want {
+				t.Errorf("codecAt(%v, gzip) = %d, want %d", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	br, gzip, zstd := offer{c: lookup("br")}, offer{c: lookup("gzip")}, offer{c: lookup("zstd")}
+	offers := []offer{br, zstd, gzip}
+	for _, tt := range []struct {
+		name   string
+		header []string
+		want   string // "" for identity
+	}{
+		{name: "no header", want: ""},
+		{name: "empty header", header: []string{""}, want: ""},
+		{name: "single", header: []string{"gzip"}, want: "gzip"},
+		{name: "alias", header: []string{"x-gzip"}, want: "gzip"},
+		{name: "refused", header: []string{"gzip;q=0"}, want: ""},
+		{name: "refused with spaces", header: []string{"gzip ; q=0.000"}, want: ""},
+		{name: "tie goes to server order", header: []string{"gzip, zstd"}, want: "zstd"},
+		{name: "client weights win", header: []string{"br;q=0.5, gzip;q=0.9"}, want: "gzip"},
+		{name: "split across headers", header: []string{"br;q=0.1", "gzip;q=0.2"}, want: "gzip"},
+		{name: "wildcard", header: []string{"*"}, want: "br"},
+		{name: "wildcard with exclusion", header: []string{"*, br;q=0"}, want: "zstd"},
+		{name: "wildcard refused", header: []string{"*;q=0"}, want: ""},
+		{name: "explicit beats wildcard", header: []string{"*;q=0.1, gzip;q=0.5"}, want: "gzip"},
+		{name: "identity preferred", header: []string{"identity, gzip;q=0.5"}, want: ""},
+		{name: "identity refused", header: []string{"identity;q=0, gzip;q=0.1"}, want: "gzip"},
+		{name: "unknown codings", header: []string{"compress, deflate"}, want: ""},
+		{name: "malformed q", header: []string{"gzip;q=2, zstd;q=abc, br;q=0.0001"}, want: ""},
+		{name: "uppercase", header: []string{"GZIP;Q=0.5"}, want: "gzip"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if i := negotiate(tt.header, offers); i != -1 {
+				got = offers[i].c.Name()
+			}
+			if got != tt.want {
+				t.Errorf("negotiate(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+
+	// with serverOrder, our order beats the client's weights, but not its refusals.
+	for header, want := range map[string]string{
+		"br;q=0.5, gzip;q=0.9":   "br",
+		"gzip, zstd;q=0.1":       "zstd",
+		"*;q=0.1, gzip":          "br",
+		"*, br;q=0":              "zstd",
+		"identity, gzip;q=0.5":   "",
+		"identity;q=0.5, gzip":   "gzip",
+		"identity;q=0, br;q=0.1": "br",
+	} {
+		got := ""
+		if i := negotiateOrder([]string{header}, offers, true); i != -1 {
+			got = offers[i].c.Name()
+		}
+		if got != want {
+			t.Errorf("negotiateOrder(%q, serverOrder) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestMediaTypesMatch(t *testing.T) {
+	defaults := newMediaTypes(nil, nil)
+	textOnly := newMediaTypes([]string{"text/*", "Application/JSON"}, []string{"text/event-stream"})
+	everything := newMediaTypes(nil, []string{})
+	for _, tt := range []struct {
+		name        string
+		m           mediaTypes
+		contentType string
+		want        bool
+	}{
+		{"defaults: json", defaults, "application/json", true},
+		{"defaults: png", defaults, "image/png", false},
+		{"defaults: svg", defaults, "image/svg+xml", true},
+		{"defaults: video wildcard", defaults, "video/mp4", false},
+		{"defaults: gzip with params", defaults, "application/gzip; name=x.tar.gz", false},
+		{"defaults: no content type", defaults, "", true},
+		{"allow: text with charset", textOnly, "text/html; charset=utf-8", true},
+		{"allow: json case-insensitive", textOnly, "application/json", true},
+		{"allow: denied subtype", textOnly, "text/event-stream", false},
+		{"allow: not listed", textOnly, "application/xml", false},
+		{"allow: no content type", textOnly, "", false},
+		{"empty deny list: png", everything, "image/png", true},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := hasGzipAt(tt.header); got != tt.want {
-				t.Errorf("hasGzipAt(%v) = %d, want %d", tt.header, got, tt.want)
+			if got := tt.m.match(tt.contentType); got != tt.want {
+				t.Errorf("match(%q) = %v, want %v", tt.contentType, got, tt.want)
 			}
 		})
 	}
 }
+
+func TestDeflateReader(t *testing.T) {
+	const want = "some deflated body, some deflated body"
+	var zlibbed, raw bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&zlibbed, flate.BestCompression)
+	io.WriteString(zw, want)
+	zw.Close()
+	fw, _ := flate.NewWriter(&raw, flate.BestSpeed)
+	io.WriteString(fw, want)
+	fw.Close()
+
+	c := lookup("deflate")
+	d := c.NewReader() // one reader for everything, as the pool would reuse it.
+	for _, tt := range []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"zlib", zlibbed.Bytes(), want},
+		{"raw", raw.Bytes(), want},
+		{"zlib again", zlibbed.Bytes(), want},
+		{"raw again", raw.Bytes(), want},
+		{"empty", nil, ""},
+	} {
+		if err := d.Reset(bytes.NewReader(tt.body)); err != nil && !(err == io.EOF && len(tt.body) == 0) {
+			t.Fatalf("%s: Reset: %v", tt.name, err)
+		}
+		if got, err := io.ReadAll(d); err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	for _, garbage := range []string{"\x78\x9c not really zlib", "\xff\xff not deflate at all"} {
+		dec, err := c.getreader(strings.NewReader(garbage))
+		if err == nil {
+			_, err = io.ReadAll(dec)
+			c.putreader(dec)
+		}
+		if err == nil {
+			t.Errorf("%q: got no error", garbage)
+		}
+	}
+	for head, want := range map[string]bool{"\x78\x9c": true, "\x78\x01": true, "\x78\xda": true, "\x08\x1d": true, "\x78\x9d": false, "\x88\x98": false, "\x0b\x00": false, "x": false} {
+		if got := isZlibHeader([]byte(head)); got != want {
+			t.Errorf("isZlibHeader(%q) = %v, want %v", head, got, want)
+		}
+	}
+}
+
+func TestHostCacheBounded(t *testing.T) {
+	var hc hostCache
+	// the first host expires soonest: it's the one evicted when the cache is full of live entries.
+	hc.set("first", offer{}, time.Minute)
+	for i := 0; i < 2*maxHosts; i++ {
+		hc.set(fmt.Sprintf("host%d", i), offer{}, time.Hour)
+		if len(hc.hosts) > maxHosts {
+			t.Fatalf("after %d hosts: cache holds %d, want at most %d", i+2, len(hc.hosts), maxHosts)
+		}
+	}
+	if _, ok := hc.get("first"); ok {
+		t.Error("the entry expiring soonest wasn't evicted")
+	}
+	if _, ok := hc.get(fmt.Sprintf("host%d", 2*maxHosts-1)); !ok {
+		t.Error("the newest entry is missing")
+	}
+	// replacing a host already in a full cache evicts nothing.
+	hc.set(fmt.Sprintf("host%d", 2*maxHosts-2), offer{}, time.Hour)
+	if len(hc.hosts) != maxHosts {
+		t.Errorf("after replacing a host: cache holds %d, want %d", len(hc.hosts), maxHosts)
+	}
+}
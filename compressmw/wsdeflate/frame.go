@@ -0,0 +1,145 @@
+// frame.go is a minimal WebSocket frame codec (RFC 6455 §5.2), for use without a WebSocket library:
+// just enough to read and write frames, masked or not, with the RSV1 bit permessage-deflate needs.
+package wsdeflate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Opcodes (RFC 6455 §5.2).
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// A Frame is a single WebSocket frame.
+type Frame struct {
+	Fin    bool // the final frame of a message
+	RSV1   bool // set on the first frame of a compressed message
+	Opcode byte
+	// Masked frames go from client to server. WriteFrame masks the payload with MaskKey (leaving Payload alone), and ReadFrame unmasks it.
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+}
+
+// ErrFrameTooLarge is returned by ReadFrame for a frame whose payload is larger than its maxPayload.
+var ErrFrameTooLarge = errors.New("wsdeflate: frame too large")
+
+// DefaultMaxPayload is the largest frame payload ReadFrame accepts when its maxPayload is 0 or less.
+const DefaultMaxPayload = 16 << 20
+
+// readChunk is how much of a payload ReadFrame allocates before the bytes arrive: a peer can claim any length in a few header bytes.
+const readChunk = 64 << 10
+
+// ReadFrame reads one frame from r, of at most maxPayload bytes of payload: 0 or less means DefaultMaxPayload.
+// It rejects frames with RSV2 or RSV3 set, and control frames that are fragmented, compressed or have more than 125 bytes of payload.
+func ReadFrame(r io.Reader, maxPayload int64) (Frame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{Fin: hdr[0]&0x80 != 0, RSV1: hdr[0]&0x40 != 0, Opcode: hdr[0] & 0x0f, Masked: hdr[1]&0x80 != 0}
+	if hdr[0]&0x30 != 0 {
+		return Frame{}, errors.New("wsdeflate: frame has RSV2 or RSV3 set")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, unexpected(err)
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, unexpected(err)
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+		if n > 1<<63-1 {
+			return Frame{}, errors.New("wsdeflate: frame length has its high bit set")
+		}
+	}
+	if f.Opcode >= OpClose && (!f.Fin || f.RSV1 || n > 125) {
+		return Frame{}, fmt.Errorf("wsdeflate: invalid control frame: opcode %#x, fin %v, rsv1 %v, %d bytes", f.Opcode, f.Fin, f.RSV1, n)
+	}
+	if maxPayload <= 0 {
+		maxPayload = DefaultMaxPayload
+	}
+	if n > uint64(maxPayload) {
+		return Frame{}, ErrFrameTooLarge
+	}
+	if f.Masked {
+		if _, err := io.ReadFull(r, f.MaskKey[:]); err != nil {
+			return Frame{}, unexpected(err)
+		}
+	}
+	// grow the payload as it arrives, rather than trusting the length up front.
+	payload := bytes.NewBuffer(make([]byte, 0, min(n, readChunk)))
+	if _, err := io.CopyN(payload, r, int64(n)); err != nil {
+		return Frame{}, unexpected(err)
+	}
+	f.Payload = payload.Bytes()
+	if f.Masked {
+		mask(f.Payload, f.MaskKey)
+	}
+	return f, nil
+}
+
+// unexpected turns io.EOF partway through a frame into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteFrame writes f to w in a single Write.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, 0, 14+len(f.Payload))
+	b0 := f.Opcode & 0x0f
+	if f.Fin {
+		b0 |= 0x80
+	}
+	if f.RSV1 {
+		b0 |= 0x40
+	}
+	var b1 byte
+	if f.Masked {
+		b1 = 0x80
+	}
+	switch n := len(f.Payload); {
+	case n <= 125:
+		buf = append(buf, b0, b1|byte(n))
+	case n <= 0xffff:
+		buf = binary.BigEndian.AppendUint16(append(buf, b0, b1|126), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint64(append(buf, b0, b1|127), uint64(n))
+	}
+	if f.Masked {
+		buf = append(buf, f.MaskKey[:]...)
+	}
+	start := len(buf)
+	buf = append(buf, f.Payload...)
+	if f.Masked {
+		mask(buf[start:], f.MaskKey)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// mask XORs b with key, in place. Masking and unmasking are the same operation.
+func mask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,341 @@
+// Package wsdeflate implements the WebSocket permessage-deflate extension (RFC 7692):
+// negotiating it in the Sec-WebSocket-Extensions header, and compressing and decompressing messages with pooled flate writers and readers.
+//
+// It doesn't implement WebSockets. Use it with any library that hands you raw message payloads and lets you set a frame's RSV1 bit,
+// or with the minimal frame codec in frame.go:
+//
+//	params, ok := wsdeflate.Negotiate(r.Header) // server: then send params.String() back in Sec-WebSocket-Extensions
+//	conn := &wsdeflate.Conn{Params: params, Server: true}
+//	defer conn.Close()
+//	payload, err := conn.Compress(msg) // send payload in a frame with RSV1 set
+//	msg, err = conn.Decompress(payload) // for frames received with RSV1 set
+package wsdeflate
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExtensionName is the extension token in Sec-WebSocket-Extensions.
+const ExtensionName = "permessage-deflate"
+
+// Params are the permessage-deflate extension parameters (RFC 7692 §7.1): an offer from a client, or a server's response.
+type Params struct {
+	// ServerNoContextTakeover: the server compresses each message on its own, rather than referring back to earlier ones.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover: the client compresses each message on its own.
+	ClientNoContextTakeover bool
+	// ServerMaxWindowBits limits the LZ77 window the server compresses with, 8 to 15. 0 means it isn't set.
+	ServerMaxWindowBits int
+	// ClientMaxWindowBits limits the LZ77 window the client compresses with, 8 to 15. 0 means it isn't set;
+	// -1 means it's set without a value, which an offer uses to say the client supports the parameter.
+	ClientMaxWindowBits int
+}
+
+// String formats p as a Sec-WebSocket-Extensions element, e.g, "permessage-deflate; client_no_context_takeover".
+func (p Params) String() string {
+	var b strings.Builder
+	b.WriteString(ExtensionName)
+	if p.ServerNoContextTakeover {
+		b.WriteString("; server_no_context_takeover")
+	}
+	if p.ClientNoContextTakeover {
+		b.WriteString("; client_no_context_takeover")
+	}
+	if p.ServerMaxWindowBits > 0 {
+		fmt.Fprintf(&b, "; server_max_window_bits=%d", p.ServerMaxWindowBits)
+	}
+	switch {
+	case p.ClientMaxWindowBits > 0:
+		fmt.Fprintf(&b, "; client_max_window_bits=%d", p.ClientMaxWindowBits)
+	case p.ClientMaxWindowBits == -1:
+		b.WriteString("; client_max_window_bits")
+	}
+	return b.String()
+}
+
+// ParseExtensions parses the values of Sec-WebSocket-Extensions headers, returning the permessage-deflate elements in order.
+// Other extensions are ignored. It returns an error for a malformed permessage-deflate element:
+// a client must then fail the connection (RFC 7692 §5). Servers should use Negotiate, which declines malformed offers instead.
+func ParseExtensions(values []string) ([]Params, error) {
+	var all []Params
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(elem, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), ExtensionName) {
+				continue
+			}
+			p, err := parseParams(params)
+			if err != nil {
+				return all, err
+			}
+			all = append(all, p)
+		}
+	}
+	return all, nil
+}
+
+// parseParams parses the parameters of a permessage-deflate element: everything after the first ';'.
+func parseParams(s string) (Params, error) {
+	var p Params
+	seen := make(map[string]bool)
+	for _, param := range strings.Split(s, ";") {
+		k, v, hasValue := strings.Cut(param, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.Trim(strings.TrimSpace(v), `"`)
+		if k == "" && !hasValue {
+			continue
+		}
+		if seen[k] {
+			return Params{}, fmt.Errorf("wsdeflate: duplicate parameter %q", k)
+		}
+		seen[k] = true
+		switch k {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if hasValue {
+				return Params{}, fmt.Errorf("wsdeflate: parameter %q takes no value", k)
+			}
+			if k == "server_no_context_takeover" {
+				p.ServerNoContextTakeover = true
+			} else {
+				p.ClientNoContextTakeover = true
+			}
+		case "server_max_window_bits", "client_max_window_bits":
+			bits := -1
+			if hasValue || k == "server_max_window_bits" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 8 || n > 15 || len(v) > 2 {
+					return Params{}, fmt.Errorf("wsdeflate: parameter %q: expected 8 <= bits <= 15, got %q", k, v)
+				}
+				bits = n
+			}
+			if k == "server_max_window_bits" {
+				p.ServerMaxWindowBits = bits
+			} else {
+				p.ClientMaxWindowBits = bits
+			}
+		default:
+			return Params{}, fmt.Errorf("wsdeflate: unknown parameter %q", k)
+		}
+	}
+	return p, nil
+}
+
+// Negotiate picks the first permessage-deflate offer in a client's Sec-WebSocket-Extensions headers that we can accept,
+// and returns the Params to send back (as Params.String) and use for the connection. ok is false if there's nothing acceptable.
+//
+// compress/flate always compresses with a 32 KiB window, so offers that limit the server's window (server_max_window_bits < 15) are declined.
+// We decompress with a 32 KiB window, so the client's window can be anything: client_max_window_bits is accepted and not echoed.
+func Negotiate(h http.Header) (p Params, ok bool) {
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, elem := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(elem, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), ExtensionName) {
+				continue
+			}
+			offer, err := parseParams(params)
+			if err != nil || (offer.ServerMaxWindowBits != 0 && offer.ServerMaxWindowBits < 15) {
+				continue
+			}
+			offer.ClientMaxWindowBits = 0
+			return offer, true
+		}
+	}
+	return Params{}, false
+}
+
+// ErrMessageTooLarge is returned by Decompress when a message decompresses to more than a Conn's MaxMessageSize.
+var ErrMessageTooLarge = errors.New("wsdeflate: message too large")
+
+// tail is appended to every compressed payload before decompressing it (RFC 7692 §7.2.2):
+// the empty stored block that Compress strips from the sync flush, and then an empty final block, so the reader ends cleanly with io.EOF.
+var tail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// maxWindow is the size of the flate LZ77 window: the most a compressed message can refer back into earlier ones.
+const maxWindow = 1 << 15
+
+// A Conn compresses and decompresses the messages of one WebSocket connection that negotiated permessage-deflate.
+// Params and Server decide whether each direction keeps its LZ77 window between messages ("context takeover").
+// Compress and Decompress may be called concurrently with each other, as a connection's reader and writer usually are,
+// but not with themselves. Call Close once the connection's done with both, to return its pooled writer.
+type Conn struct {
+	// Params are the negotiated parameters.
+	Params Params
+	// Server is true for the server's end of the connection, false for the client's.
+	Server bool
+	// Level is the flate compression level, from 1 (flate.BestSpeed) to 9 (flate.BestCompression). 0 or -1 use the default, 6.
+	Level int
+	// MaxMessageSize limits a decompressed message, in bytes. 0 means no limit.
+	MaxMessageSize int64
+
+	w    *flate.Writer // with context takeover, the writer we keep between messages, writing to wbuf.
+	wbuf bytes.Buffer
+	wlvl int
+	dict []byte // with context takeover, the end of the messages we've decompressed so far.
+}
+
+// takeover reports whether we keep the compressor's window between the messages we send (out) or receive (!out).
+func (c *Conn) takeover(out bool) bool {
+	if out == c.Server {
+		return !c.Params.ServerNoContextTakeover
+	}
+	return !c.Params.ClientNoContextTakeover
+}
+
+// level returns the flate level to compress with.
+func (c *Conn) level() (int, error) {
+	switch {
+	case c.Level == 0 || c.Level == -1:
+		return 6, nil
+	case flate.BestSpeed <= c.Level && c.Level <= flate.BestCompression:
+		return c.Level, nil
+	default:
+		return 0, fmt.Errorf("wsdeflate: invalid compression level: expected %d <= level <= %d (or 0 or -1 for the default), got %d", flate.BestSpeed, flate.BestCompression, c.Level)
+	}
+}
+
+// Compress compresses msg into the payload of a message to send with RSV1 set on its first frame.
+// The payload is newly allocated: it's safe to keep.
+// compress/flate always compresses with a 32 KiB window, so it fails if the parameters limit ours to less
+// (a client whose server responded with client_max_window_bits < 15): the peer couldn't decompress what we'd send.
+func (c *Conn) Compress(msg []byte) ([]byte, error) {
+	lvl, err := c.level()
+	if err != nil {
+		return nil, err
+	}
+	bits := c.Params.ClientMaxWindowBits
+	if c.Server {
+		bits = c.Params.ServerMaxWindowBits
+	}
+	if bits > 0 && bits < 15 {
+		return nil, fmt.Errorf("wsdeflate: can't compress with a %d-bit window: compress/flate always uses 15 bits", bits)
+	}
+	var out *bytes.Buffer
+	if c.takeover(true) {
+		if c.w == nil {
+			c.w, c.wlvl = getwriter(&c.wbuf, lvl), lvl
+		}
+		c.wbuf.Reset()
+		if err := compress(c.w, msg); err != nil {
+			return nil, err
+		}
+		out = &c.wbuf
+	} else {
+		buf := getbuf()
+		defer putbuf(buf)
+		w := getwriter(buf, lvl)
+		err := compress(w, msg)
+		putwriter(w, lvl)
+		if err != nil {
+			return nil, err
+		}
+		out = buf
+	}
+	// a sync flush always ends with an empty stored block, 0x00 0x00 0xff 0xff: the receiver adds it back.
+	return bytes.Clone(bytes.TrimSuffix(out.Bytes(), tail[:4])), nil
+}
+
+// compress writes msg to w and sync-flushes it.
+func compress(w *flate.Writer, msg []byte) error {
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Decompress decompresses the payload of a message received with RSV1 set on its first frame (the payloads of all its frames, joined).
+func (c *Conn) Decompress(payload []byte) ([]byte, error) {
+	var dict []byte
+	takeover := c.takeover(false)
+	if takeover {
+		dict = c.dict
+	}
+	r, err := getreader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(tail)), dict)
+	if err != nil {
+		return nil, err
+	}
+	defer putreader(r)
+	var src io.Reader = r
+	if c.MaxMessageSize > 0 {
+		src = io.LimitReader(r, c.MaxMessageSize+1)
+	}
+	msg, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("wsdeflate: malformed message: %w", err)
+	}
+	if c.MaxMessageSize > 0 && int64(len(msg)) > c.MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	if takeover {
+		c.dict = append(c.dict, msg...)
+		if len(c.dict) > maxWindow {
+			c.dict = append(c.dict[:0], c.dict[len(c.dict)-maxWindow:]...)
+		}
+	}
+	return msg, nil
+}
+
+// Close returns the Conn's pooled writer, if it has one. The Conn is still usable afterwards: it gets another writer if it needs one.
+func (c *Conn) Close() {
+	if c.w != nil {
+		putwriter(c.w, c.wlvl)
+		c.w = nil
+	}
+	c.wbuf = bytes.Buffer{}
+	c.dict = nil
+}
+
+// pools, like compressmw's: flate writers per level, and readers.
+var (
+	writers [flate.BestCompression + 1]sync.Pool
+	readers = sync.Pool{New: func() interface{} { return flate.NewReader(nil) }}
+	bufpool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+)
+
+func init() {
+	for lvl := flate.BestSpeed; lvl <= flate.BestCompression; lvl++ {
+		lvl := lvl
+		writers[lvl].New = func() interface{} {
+			w, err := flate.NewWriter(nil, lvl)
+			if err != nil {
+				panic(err) // lvl is always valid.
+			}
+			return w
+		}
+	}
+}
+
+func getbuf() *bytes.Buffer    { return bufpool.Get().(*bytes.Buffer) }
+func putbuf(buf *bytes.Buffer) { buf.Reset(); bufpool.Put(buf) }
+
+func getwriter(w io.Writer, lvl int) *flate.Writer {
+	fw := writers[lvl].Get().(*flate.Writer)
+	fw.Reset(w)
+	return fw
+}
+
+// putwriter returns a writer to the pool. Unlike compressmw's, it doesn't Close it: that would write a final block nobody wants.
+func putwriter(fw *flate.Writer, lvl int) {
+	fw.Reset(io.Discard)
+	writers[lvl].Put(fw)
+}
+
+func getreader(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	fr := readers.Get().(io.ReadCloser)
+	if err := fr.(flate.Resetter).Reset(r, dict); err != nil {
+		readers.Put(fr)
+		return nil, err
+	}
+	return fr, nil
+}
+
+func putreader(fr io.ReadCloser) {
+	fr.(flate.Resetter).Reset(bytes.NewReader(nil), nil)
+	readers.Put(fr)
+}
@@ -0,0 +1,266 @@
+package wsdeflate_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/runpod/rpcompress/compressmw/wsdeflate"
+)
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		offer string
+		want  string // "" for no agreement
+	}{
+		{"permessage-deflate", "permessage-deflate"},
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate"},
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover", "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{`permessage-deflate; server_max_window_bits="15"`, "permessage-deflate; server_max_window_bits=15"},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", "permessage-deflate"}, // we can't limit our window: take the fallback.
+		{"permessage-deflate; server_max_window_bits=10", ""},
+		{"permessage-deflate; bogus", ""},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", ""},
+		{"permessage-deflate; client_max_window_bits=16", ""},
+		{"x-webkit-deflate-frame, PerMessage-Deflate", "permessage-deflate"},
+		{"x-webkit-deflate-frame", ""},
+		{"", ""},
+	} {
+		h := http.Header{"Sec-Websocket-Extensions": {tt.offer}}
+		p, ok := wsdeflate.Negotiate(h)
+		got := ""
+		if ok {
+			got = p.String()
+		}
+		if got != tt.want {
+			t.Errorf("Negotiate(%q): got %q, want %q", tt.offer, got, tt.want)
+		}
+	}
+
+	// a client parses the server's response strictly.
+	if _, err := wsdeflate.ParseExtensions([]string{"permessage-deflate; bogus"}); err == nil {
+		t.Error("ParseExtensions: got no error for an unknown parameter")
+	}
+	got, err := wsdeflate.ParseExtensions([]string{"foo, permessage-deflate; client_max_window_bits=10"})
+	if err != nil || len(got) != 1 || got[0] != (wsdeflate.Params{ClientMaxWindowBits: 10}) {
+		t.Errorf("ParseExtensions: got %+v, %v", got, err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	t.Parallel()
+	msgs := []string{
+		"",
+		`{"job": "abc123", "status": "IN_PROGRESS"}`,
+		`{"job": "abc123", "status": "IN_PROGRESS"}`,
+		strings.Repeat(`{"job": "abc123", "status": "COMPLETED"}`, 2000), // longer than the window
+		`{"job": "abc123", "status": "COMPLETED"}`,
+	}
+	for _, p := range []wsdeflate.Params{{}, {ServerNoContextTakeover: true, ClientNoContextTakeover: true}, {ClientNoContextTakeover: true}} {
+		// flate only bothers looking back into earlier messages for short ones at its best compression.
+		server, client := &wsdeflate.Conn{Params: p, Server: true, Level: flate.BestCompression}, &wsdeflate.Conn{Params: p, Level: flate.BestCompression}
+		for dir, ends := range map[string][2]*wsdeflate.Conn{"server to client": {server, client}, "client to server": {client, server}} {
+			var sizes []int
+			for _, msg := range msgs {
+				payload, err := ends[0].Compress([]byte(msg))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sizes = append(sizes, len(payload))
+				got, err := ends[1].Decompress(payload)
+				if err != nil || string(got) != msg {
+					t.Fatalf("%+v: %s: got %q, %v, want %q", p, dir, got, err, msg)
+				}
+			}
+			// with context takeover, a repeated message refers back to the last one, and compresses smaller.
+			takeover := !p.ServerNoContextTakeover
+			if ends[0] == client {
+				takeover = !p.ClientNoContextTakeover
+			}
+			if smaller := sizes[2] < sizes[1]; smaller != takeover {
+				t.Errorf("%+v: %s: repeated message compressed from %d to %d bytes: takeover is %v", p, dir, sizes[1], sizes[2], takeover)
+			}
+		}
+		server.Close()
+		client.Close()
+	}
+
+	// a payload is raw deflate, less the empty stored block that ends a sync flush.
+	payload, err := (&wsdeflate.Conn{}).Compress([]byte("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(payload), strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff"))))
+	if err != nil || string(got) != "Hello" {
+		t.Errorf("compress/flate: got %q, %v", got, err)
+	}
+	// RFC 7692 §7.2.3.1's example.
+	got, err = (&wsdeflate.Conn{}).Decompress([]byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00})
+	if err != nil || string(got) != "Hello" {
+		t.Errorf("RFC 7692 example: got %q, %v", got, err)
+	}
+
+	// limits and errors.
+	big, err := (&wsdeflate.Conn{}).Compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&wsdeflate.Conn{MaxMessageSize: 1 << 10}).Decompress(big); !errors.Is(err, wsdeflate.ErrMessageTooLarge) {
+		t.Errorf("MaxMessageSize: got %v, want %v", err, wsdeflate.ErrMessageTooLarge)
+	}
+	if _, err := (&wsdeflate.Conn{}).Decompress([]byte("\xff\xff\xff not deflate")); err == nil {
+		t.Error("got no error decompressing garbage")
+	}
+	if _, err := (&wsdeflate.Conn{Level: 10}).Compress(nil); err == nil {
+		t.Error("got no error for level 10")
+	}
+	// we can't honor a limit on our own window, only the peer's.
+	for _, tt := range []struct {
+		c  wsdeflate.Conn
+		ok bool
+	}{
+		{wsdeflate.Conn{Params: wsdeflate.Params{ClientMaxWindowBits: 10}}, false},
+		{wsdeflate.Conn{Params: wsdeflate.Params{ClientMaxWindowBits: 15}}, true},
+		{wsdeflate.Conn{Params: wsdeflate.Params{ClientMaxWindowBits: -1}}, true},
+		{wsdeflate.Conn{Params: wsdeflate.Params{ClientMaxWindowBits: 10}, Server: true}, true},
+		{wsdeflate.Conn{Params: wsdeflate.Params{ServerMaxWindowBits: 10}, Server: true}, false},
+		{wsdeflate.Conn{Params: wsdeflate.Params{ServerMaxWindowBits: 10}}, true},
+	} {
+		if _, err := tt.c.Compress([]byte("Hello")); (err == nil) != tt.ok {
+			t.Errorf("%+v, server %v: got error %v", tt.c.Params, tt.c.Server, err)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	t.Parallel()
+	for _, n := range []int{0, 125, 126, 1 << 16} {
+		for _, masked := range []bool{false, true} {
+			want := wsdeflate.Frame{Fin: true, RSV1: true, Opcode: wsdeflate.OpBinary, Masked: masked, Payload: bytes.Repeat([]byte{'x'}, n)}
+			if masked {
+				want.MaskKey = [4]byte{1, 2, 3, 4}
+			}
+			var buf bytes.Buffer
+			if err := wsdeflate.WriteFrame(&buf, want); err != nil {
+				t.Fatal(err)
+			}
+			if masked && n > 0 && bytes.Contains(buf.Bytes(), want.Payload) {
+				t.Errorf("%d bytes: the payload wasn't masked", n)
+			}
+			got, err := wsdeflate.ReadFrame(&buf, 0)
+			if err != nil {
+				t.Fatalf("%d bytes, masked=%v: %v", n, masked, err)
+			}
+			if got.Fin != want.Fin || got.RSV1 != want.RSV1 || got.Opcode != want.Opcode || got.Masked != want.Masked || got.MaskKey != want.MaskKey || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("%d bytes, masked=%v: got a different frame back", n, masked)
+			}
+		}
+	}
+
+	for name, frame := range map[string][]byte{
+		"rsv2":                   {0x82 | 0x20, 0x00},
+		"fragmented control":     {byte(wsdeflate.OpPing), 0x00},
+		"compressed control":     {0x80 | 0x40 | byte(wsdeflate.OpPing), 0x00},
+		"long control":           {0x80 | byte(wsdeflate.OpPing), 126, 0x00, 126},
+		"truncated":              {0x82, 0x05, 'a'},
+		"larger than maxPayload": {0x82, 126, 0x10, 0x00},
+		"claims 2^62 bytes":      {0x82, 127, 0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		if _, err := wsdeflate.ReadFrame(bytes.NewReader(frame), 1<<10); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+	// with no limit of our own, the default still applies, and a truncated frame doesn't cost its claimed length.
+	for _, frame := range [][]byte{{0x82, 127, 0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, {0x82, 127, 0, 0, 0, 0, 0, 0xf0, 0, 0, 'a'}} {
+		if _, err := wsdeflate.ReadFrame(bytes.NewReader(frame), 0); err == nil {
+			t.Errorf("% x: got no error", frame[:10])
+		}
+	}
+}
+
+// TestWebSocket runs a compressed echo over a real (if minimal) WebSocket handshake.
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := wsdeflate.Negotiate(r.Header)
+		if !ok {
+			http.Error(w, "no permessage-deflate", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Extensions: " + p.String() + "\r\n\r\n")
+		brw.Flush()
+		ws := &wsdeflate.Conn{Params: p, Server: true}
+		defer ws.Close()
+		for {
+			f, err := wsdeflate.ReadFrame(brw, 1<<20)
+			if err != nil || f.Opcode == wsdeflate.OpClose {
+				return
+			}
+			msg, err := ws.Decompress(f.Payload)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			payload, err := ws.Compress(append([]byte("echo: "), msg...))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			wsdeflate.WriteFrame(conn, wsdeflate.Frame{Fin: true, RSV1: true, Opcode: f.Opcode, Payload: payload})
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agreed, err := wsdeflate.ParseExtensions(resp.Header.Values("Sec-WebSocket-Extensions"))
+	if resp.StatusCode != http.StatusSwitchingProtocols || err != nil || len(agreed) != 1 {
+		t.Fatalf("handshake: got status %d, extensions %+v, %v", resp.StatusCode, agreed, err)
+	}
+	ws := &wsdeflate.Conn{Params: agreed[0]}
+	defer ws.Close()
+	for _, msg := range []string{`{"status": "IN_QUEUE"}`, `{"status": "IN_PROGRESS"}`, `{"status": "IN_PROGRESS"}`} {
+		payload, err := ws.Compress([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wsdeflate.WriteFrame(conn, wsdeflate.Frame{Fin: true, RSV1: true, Opcode: wsdeflate.OpText, Masked: true, MaskKey: [4]byte{9, 8, 7, 6}, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		f, err := wsdeflate.ReadFrame(br, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ws.Decompress(f.Payload)
+		if err != nil || !f.RSV1 || string(got) != "echo: "+msg {
+			t.Errorf("got %q, %v (rsv1 %v), want %q", got, err, f.RSV1, "echo: "+msg)
+		}
+	}
+	wsdeflate.WriteFrame(conn, wsdeflate.Frame{Fin: true, Opcode: wsdeflate.OpClose, Masked: true})
+}
@@ -5,6 +5,7 @@ go 1.21.6
 require (
 	github.com/andybalholm/brotli v1.1.0
 	github.com/gin-gonic/gin v1.9.1
+	github.com/klauspost/compress v1.17.11
 )
 
 require (